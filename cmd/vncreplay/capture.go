@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/thijzert/vncreplay/rfb"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// serverVersionPattern matches the start of the first message a VNC server
+// sends
+var serverVersionPattern = regexp.MustCompile(`^RFB \d{3}\.\d{3}\n`)
+
+// repeaterVersion is the ProtocolVersion message an UltraVNC repeater sends
+// to a viewer
+var repeaterVersion = []byte("RFB 000.000\n")
+
+// A stream describes a TCP stream in a capture that carries a VNC session
+type stream struct {
+	// Number identifies the stream on the command line, starting at 1
+	Number int
+
+	Client, Server string
+	Start          time.Time
+
+	// ClientBytes and ServerBytes count the payload bytes sent by either
+	// side, including retransmissions
+	ClientBytes, ServerBytes int
+
+	// MidStream is set if the capture starts after the handshake
+	MidStream bool
+
+	// flow identifies the TCP stream in the capture
+	flow flowID
+}
+
+// A flowID identifies a TCP stream in a capture. Streams are identified by
+// their endpoints, sorted, and the number of earlier streams between them.
+type flowID struct {
+	endpoints  [2]string
+	generation int
+}
+
+// A flow collects what we know about a TCP stream while scanning a capture
+type flow struct {
+	flowID
+	start time.Time
+	bytes [2]int
+	// first contains the first payload each side sent, and firstTime the
+	// time at which it was captured
+	first     [2][]byte
+	firstTime [2]time.Time
+	// client is the side that sent the initial SYN, or -1 if the handshake
+	// wasn't captured
+	client int
+	// isn is the initial sequence number of the client, if its SYN was
+	// captured
+	isn     uint32
+	synSeen bool
+	// payload is set once either side has sent data
+	payload bool
+	// guesses counts, for each side, how many segments looked like they
+	// were sent by a client or a server
+	guesses [2]map[rfb.Direction]int
+}
+
+// tcpPacket is called for every TCP packet in a capture, along with the
+// endpoints it was sent from and to
+type tcpPacket func(meta *gopacket.PacketMetadata, src, dst string, tcp *layers.TCP)
+
+// readTCPPackets calls f for every TCP packet in a capture file
+func readTCPPackets(inFile string, f tcpPacket) error {
+	handle, err := pcap.OpenOffline(inFile)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	for packet := range packetSource.Packets() {
+		tcpLayer := packet.Layer(layers.LayerTypeTCP)
+		net := packet.NetworkLayer()
+		if tcpLayer == nil || net == nil {
+			continue
+		}
+		tcp, _ := tcpLayer.(*layers.TCP)
+
+		srcIP, dstIP := net.NetworkFlow().Endpoints()
+		src := fmt.Sprintf("%s:%d", srcIP, tcp.SrcPort)
+		dst := fmt.Sprintf("%s:%d", dstIP, tcp.DstPort)
+		f(packet.Metadata(), src, dst, tcp)
+	}
+
+	return nil
+}
+
+// A flowTable tells apart the TCP streams in a capture. A new SYN between
+// endpoints that already had a stream starts a new one, so reused port
+// numbers don't merge two sessions.
+type flowTable struct {
+	flows map[[2]string]*flow
+	order []*flow
+}
+
+func newFlowTable() *flowTable {
+	return &flowTable{flows: make(map[[2]string]*flow)}
+}
+
+// lookup returns the flow a packet belongs to, and which side of it sent
+// the packet
+func (ft *flowTable) lookup(meta *gopacket.PacketMetadata, src, dst string, tcp *layers.TCP) (*flow, int) {
+	key := [2]string{src, dst}
+	if dst < src {
+		key = [2]string{dst, src}
+	}
+	side := 0
+	if src == key[1] {
+		side = 1
+	}
+
+	fl, ok := ft.flows[key]
+	newConnection := ok && tcp.SYN && !tcp.ACK && (fl.payload || (fl.synSeen && fl.isn != tcp.Seq))
+	if !ok || newConnection {
+		id := flowID{endpoints: key}
+		if ok {
+			// A new connection between the same endpoints
+			id.generation = fl.generation + 1
+		}
+		fl = &flow{flowID: id, start: meta.Timestamp, client: -1}
+		fl.guesses[0] = make(map[rfb.Direction]int)
+		fl.guesses[1] = make(map[rfb.Direction]int)
+		ft.flows[key] = fl
+		ft.order = append(ft.order, fl)
+	}
+
+	if tcp.SYN && tcp.ACK {
+		fl.client = 1 - side
+	} else if tcp.SYN {
+		fl.client = side
+		fl.isn = tcp.Seq
+		fl.synSeen = true
+	}
+	if len(tcp.Payload) > 0 {
+		fl.payload = true
+	}
+
+	return fl, side
+}
+
+// findStreams scans a capture for TCP streams that carry a VNC session. A
+// stream is recognised by the ProtocolVersion message the server sends
+// first.
+func findStreams(inFile string) ([]*stream, error) {
+	ft := newFlowTable()
+
+	err := readTCPPackets(inFile, func(meta *gopacket.PacketMetadata, src, dst string, tcp *layers.TCP) {
+		fl, side := ft.lookup(meta, src, dst, tcp)
+		if len(tcp.Payload) == 0 {
+			return
+		}
+		fl.bytes[side] += len(tcp.Payload)
+		if fl.first[side] == nil {
+			fl.first[side] = tcp.Payload
+			fl.firstTime[side] = meta.Timestamp
+		}
+		fl.guesses[side][rfb.GuessDirection(tcp.Payload)]++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []*stream
+	for _, fl := range ft.order {
+		server := fl.server()
+		midStream := false
+		if server < 0 {
+			// Without a handshake, the flow can still be recognised by
+			// the messages either side sends
+			server = fl.guessServer()
+			midStream = true
+		}
+		if server < 0 {
+			continue
+		}
+
+		client := 1 - server
+		rv = append(rv, &stream{
+			Client:      fl.endpoints[client],
+			Server:      fl.endpoints[server],
+			Start:       fl.start,
+			ClientBytes: fl.bytes[client],
+			ServerBytes: fl.bytes[server],
+			MidStream:   midStream,
+			flow:        fl.flowID,
+		})
+	}
+
+	sort.SliceStable(rv, func(i, j int) bool {
+		return rv[i].Start.Before(rv[j].Start)
+	})
+	for i, s := range rv {
+		s.Number = i + 1
+	}
+	return rv, nil
+}
+
+// server returns which side of a flow is the VNC server, or -1 if neither
+// side starts with a ProtocolVersion message. The server sends its version
+// first, and the client replies with one of its own. Which side opened the
+// connection only breaks a tie, since a server can connect to a listening
+// viewer too.
+func (fl *flow) server() int {
+	var version [2]bool
+	for side := range fl.first {
+		version[side] = serverVersionPattern.Match(fl.first[side])
+	}
+	if !version[0] && !version[1] {
+		return -1
+	}
+
+	for side := range fl.first {
+		// An UltraVNC repeater talks to viewers like a server, with a
+		// version of its own. VNC servers connect to the repeater, and
+		// identify themselves before anything else is sent.
+		if bytes.HasPrefix(fl.first[side], repeaterVersion) {
+			return side
+		} else if bytes.HasPrefix(fl.first[side], []byte("ID:")) && !bytes.HasPrefix(fl.first[1-side], repeaterVersion) {
+			return side
+		}
+	}
+
+	if version[0] != version[1] {
+		if version[0] {
+			return 0
+		}
+		return 1
+	} else if fl.firstTime[0].Before(fl.firstTime[1]) {
+		return 0
+	} else if fl.firstTime[1].Before(fl.firstTime[0]) {
+		return 1
+	}
+
+	if fl.client >= 0 {
+		return 1 - fl.client
+	}
+	return 0
+}
+
+// guessServer returns which side of a flow is the VNC server, judging by
+// the messages each side sent, or -1 if the flow doesn't look like VNC
+func (fl *flow) guessServer() int {
+	// Count the segments that agree with each side being the server
+	var agree [2]int
+	votes := 0
+	for side := range fl.guesses {
+		other := 1 - side
+		agree[side] = fl.guesses[side][rfb.DirectionServer] + fl.guesses[other][rfb.DirectionClient]
+		votes += fl.guesses[side][rfb.DirectionServer] + fl.guesses[side][rfb.DirectionClient]
+	}
+
+	for side := range agree {
+		// Demand a few messages, almost all of which agree
+		if votes >= minGuesses && 10*agree[side] >= 9*votes {
+			return side
+		}
+	}
+	return -1
+}
+
+// minGuesses is the number of recognisable messages a flow without a
+// handshake needs to be considered a VNC session
+const minGuesses = 4
+
+// listStreams writes a table of VNC streams
+func listStreams(w io.Writer, streams []*stream) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Stream\tStart\tClient\tServer\tClient bytes\tServer bytes\tHandshake\n")
+	for _, s := range streams {
+		handshake := "yes"
+		if s.MidStream {
+			handshake = "no"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%d\t%s\n", s.Number, s.Start.Format("2006-01-02 15:04:05.000"), s.Client, s.Server, s.ClientBytes, s.ServerBytes, handshake)
+	}
+	tw.Flush()
+}
+
+// readCapture feeds the packets of one VNC stream in a capture file to the
+// replay. Segments the replay rejects are skipped, and reported in a
+// *segmentError once the whole stream has been read.
+func readCapture(inFile string, s *stream, replay *rfb.RFB) error {
+	var serverSeq, clientSeq sequence
+	var ignored *segmentError
+	ft := newFlowTable()
+
+	err := readTCPPackets(inFile, func(meta *gopacket.PacketMetadata, src, dst string, tcp *layers.TCP) {
+		if fl, _ := ft.lookup(meta, src, dst, tcp); fl.flowID != s.flow {
+			return
+		}
+
+		var seq *sequence
+		var add func(time.Duration, int, []byte) error
+		if src == s.Server {
+			seq, add = &serverSeq, replay.ServerBytes
+		} else {
+			seq, add = &clientSeq, replay.ClientBytes
+		}
+
+		if tcp.SYN {
+			seq.Start(tcp.Seq + 1)
+		}
+		if len(tcp.Payload) == 0 {
+			return
+		}
+
+		tpacket := meta.Timestamp.Sub(s.Start)
+		if err := add(tpacket, int(seq.Offset(tcp.Seq)), tcp.Payload); err != nil {
+			if ignored == nil {
+				ignored = &segmentError{First: err}
+			}
+			ignored.Count++
+		}
+	})
+	if err != nil {
+		return err
+	} else if ignored != nil {
+		return ignored
+	}
+	return nil
+}
+
+// A segmentError reports the segments of a stream that couldn't be added to
+// the replay. The rest of the stream was read regardless.
+type segmentError struct {
+	Count int
+	First error
+}
+
+func (e *segmentError) Error() string {
+	if e.Count == 1 {
+		return fmt.Sprintf("ignored a segment: %s", e.First)
+	}
+	return fmt.Sprintf("ignored %d segments; the first: %s", e.Count, e.First)
+}
+
+// A sequence converts the 32-bit sequence numbers of one direction of a TCP
+// stream to 64-bit offsets from the start of the stream, accounting for
+// wraparound
+type sequence struct {
+	started bool
+	start   uint32
+	highest int64
+}
+
+// Start sets the sequence number of the first byte in the stream
+func (s *sequence) Start(seq uint32) {
+	if s.started && s.start == seq {
+		// Retransmitted SYN
+		return
+	}
+	s.started = true
+	s.start = seq
+	s.highest = 0
+}
+
+// Offset returns the stream offset of a sequence number. Of all offsets with
+// the same lower 32 bits, it picks the one closest to the highest offset seen
+// so far.
+func (s *sequence) Offset(seq uint32) int64 {
+	if !s.started {
+		// Without a SYN, the stream starts at the first segment we see
+		s.Start(seq)
+	}
+
+	highestSeq := s.start + uint32(s.highest)
+	rv := s.highest + int64(int32(seq-highestSeq))
+	if rv > s.highest {
+		s.highest = rv
+	}
+	return rv
+}
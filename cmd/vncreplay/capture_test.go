@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSequenceOffset(t *testing.T) {
+	type step struct {
+		seq  uint32
+		want int64
+	}
+
+	tests := []struct {
+		name string
+		// syn lists the sequence numbers Start is called with, if any
+		syn   []uint32
+		steps []step
+	}{
+		{
+			name:  "in order",
+			syn:   []uint32{1000},
+			steps: []step{{1000, 0}, {1010, 10}, {1025, 25}},
+		},
+		{
+			name:  "reordered",
+			syn:   []uint32{1000},
+			steps: []step{{1010, 10}, {1000, 0}, {1025, 25}, {1015, 15}},
+		},
+		{
+			name:  "before the start",
+			syn:   []uint32{1000},
+			steps: []step{{990, -10}, {1000, 0}},
+		},
+		{
+			name:  "no SYN",
+			steps: []step{{5000, 0}, {5100, 100}, {4900, -100}},
+		},
+		{
+			name:  "retransmitted SYN",
+			syn:   []uint32{1000, 1000},
+			steps: []step{{1100, 100}},
+		},
+		{
+			name:  "wrap past 0xffffffff",
+			syn:   []uint32{0xfffffff0},
+			steps: []step{{0xfffffff0, 0}, {0xfffffffa, 10}, {0x00000005, 21}, {0x00000010, 32}},
+		},
+		{
+			name:  "wrap exactly at 0xffffffff",
+			syn:   []uint32{0xffffffff},
+			steps: []step{{0xffffffff, 0}, {0x00000000, 1}, {0x00000001, 2}},
+		},
+		{
+			name:  "old segment after the wrap",
+			syn:   []uint32{0xfffffff0},
+			steps: []step{{0xfffffff0, 0}, {0x00000010, 32}, {0xfffffff8, 8}, {0x00000020, 48}},
+		},
+		{
+			name:  "reordered across the wrap",
+			syn:   []uint32{0xfffffff0},
+			steps: []step{{0x00000010, 32}, {0xfffffff0, 0}, {0x00000000, 16}},
+		},
+		{
+			name: "wrap more than once",
+			syn:  []uint32{0x80000000},
+			steps: []step{
+				{0xc0000000, 0x040000000},
+				{0x00000000, 0x080000000},
+				{0x40000000, 0x0c0000000},
+				{0x80000000, 0x100000000},
+				{0xc0000000, 0x140000000},
+				{0x00000000, 0x180000000},
+				{0xfffffff0, 0x17ffffff0},
+				{0x40000000, 0x1c0000000},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var s sequence
+			for _, seq := range tc.syn {
+				s.Start(seq)
+			}
+			for i, st := range tc.steps {
+				if got := s.Offset(st.seq); got != st.want {
+					t.Errorf("step %d: Offset(0x%08x) = 0x%x; want 0x%x", i, st.seq, got, st.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFlowServer(t *testing.T) {
+	t0 := time.Unix(1500000000, 0)
+	t1 := t0.Add(time.Millisecond)
+	version := []byte("RFB 003.008\n")
+
+	tests := []struct {
+		name      string
+		first     [2][]byte
+		firstTime [2]time.Time
+		// client is the side that sent the SYN, or -1
+		client int
+		want   int
+	}{
+		{"client connects", [2][]byte{version, version}, [2]time.Time{t1, t0}, 0, 1},
+		{"server connects", [2][]byte{version, version}, [2]time.Time{t0, t1}, 0, 0},
+		{"server connects, viewer silent", [2][]byte{version, nil}, [2]time.Time{t0, {}}, 0, 0},
+		{"no SYN", [2][]byte{version, version}, [2]time.Time{t1, t0}, -1, 1},
+		{"same time", [2][]byte{version, version}, [2]time.Time{t0, t0}, 0, 1},
+		{"same time, no SYN", [2][]byte{version, version}, [2]time.Time{t0, t0}, -1, 0},
+		{"only one version", [2][]byte{[]byte("GET / HTTP/1.1\r\n"), version}, [2]time.Time{t0, t1}, 1, 1},
+		{"repeater", [2][]byte{[]byte("RFB 000.000\n"), version}, [2]time.Time{t1, t0}, 1, 0},
+		{"not VNC", [2][]byte{[]byte("SSH-2.0-OpenSSH\r\n"), nil}, [2]time.Time{t0, {}}, 0, -1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fl := &flow{first: tc.first, firstTime: tc.firstTime, client: tc.client}
+			if got := fl.server(); got != tc.want {
+				t.Errorf("got side %d; want %d", got, tc.want)
+			}
+		})
+	}
+}
@@ -1,98 +1,343 @@
 package main
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"os"
-	"time"
+	"path/filepath"
+	"strings"
 
 	"github.com/thijzert/vncreplay/rfb"
-
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
 func main() {
-	var inFile, outFile string
-	var embedAssets bool
+	var inFile, outFile, wordlistFile, dhKeys, keyLogFile, rsaKeyFile, geometry, pixelFormat string
+	var embedAssets, all bool
+	var streamNumber int
 	flag.StringVar(&inFile, "i", "", "Input file")
 	flag.StringVar(&outFile, "o", "replay.html", "Output file")
 	flag.BoolVar(&embedAssets, "embedAssets", true, "Embed static assets in the output HTML")
+	flag.StringVar(&wordlistFile, "wordlist", "", "Try to recover the VNC password using this list of candidates")
+	flag.StringVar(&dhKeys, "dhkey", "", "Comma-separated list of hexadecimal Diffie-Hellman private values, used to decrypt credentials. This is the only way to decrypt ARD credentials; a wordlist doesn't help")
+	flag.StringVar(&keyLogFile, "keylog", "", "Decrypt TLS sessions using this key log file (SSLKEYLOGFILE)")
+	flag.StringVar(&rsaKeyFile, "rsakey", "", "Decrypt TLS sessions with RSA key exchange using this PEM-encoded private key")
+	flag.IntVar(&streamNumber, "stream", 0, "Replay the VNC session in this stream, if the capture contains more than one")
+	flag.BoolVar(&all, "all", false, "Replay every VNC session in the capture")
+	flag.StringVar(&geometry, "geometry", "", "Display size (WIDTHxHEIGHT) of sessions whose capture starts mid-stream")
+	flag.StringVar(&pixelFormat, "pixelformat", "", "Pixel format (rgb888, rgb565, rgb555 or bgr233) of sessions whose capture starts mid-stream")
 	flag.Parse()
 
+	args := flag.Args()
+	var command string
+	if len(args) > 0 && (args[0] == "auth" || args[0] == "list") {
+		command = args[0]
+		args = args[1:]
+	}
+
 	if inFile == "" {
-		if len(flag.Args()) > 0 {
-			inFile = flag.Args()[0]
+		if len(args) > 0 {
+			inFile = args[0]
 		} else {
-			log.Fatalf("Usage: %s [-o OUTFILE] INFILE", os.Args[0])
+			log.Fatalf("Usage: %s [-o OUTFILE] [-stream N | -all] [-wordlist FILE] [-keylog FILE] [-geometry WxH] INFILE\n       %s [-stream N | -all] [-wordlist FILE] [-keylog FILE] auth INFILE\n       %s list INFILE", os.Args[0], os.Args[0], os.Args[0])
 		}
 	}
 
-	out, err := os.Create(outFile)
+	var keys secrets
+	if wordlistFile != "" {
+		wordlist, err := os.Open(wordlistFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer wordlist.Close()
+		keys.wordlist = wordlist
+	}
+
+	var err error
+	keys.dhPrivateKeys, err = parsePrivateKeys(dhKeys)
 	if err != nil {
 		log.Fatal(err)
 	}
-	replay, err := rfb.New(out)
+	if keyLogFile != "" {
+		keys.keyLog, err = readKeyLog(keyLogFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if rsaKeyFile != "" {
+		keys.rsaKey, err = readRSAKey(rsaKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	midStream, err := parseMidStreamOptions(geometry, pixelFormat)
 	if err != nil {
 		log.Fatal(err)
 	}
-	replay.EmbedAssets = embedAssets
-	defer replay.Close()
 
-	var handle *pcap.Handle
+	streams, err := findStreams(inFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if command == "list" {
+		listStreams(os.Stdout, streams)
+		return
+	}
 
-	// Open pcap file
-	handle, err = pcap.OpenOffline(inFile)
+	selected, err := selectStreams(streams, streamNumber, all)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer handle.Close()
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	// A stream that fails doesn't stop the others from being processed
+	failed := 0
+	for _, s := range selected {
+		if command == "auth" {
+			if len(selected) > 1 {
+				fmt.Printf("Stream %d:\n", s.Number)
+			}
+			err = printAuth(inFile, s, keys)
+			if len(selected) > 1 {
+				fmt.Printf("\n")
+			}
+		} else {
+			filename := outFile
+			if len(selected) > 1 {
+				filename = numberedFilename(outFile, s.Number)
+			}
+			err = writeReplay(inFile, s, filename, embedAssets, keys, midStream)
+		}
+		if err != nil {
+			log.Printf("Stream %d: %s", s.Number, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		if len(selected) > 1 {
+			log.Printf("%d of %d streams failed", failed, len(selected))
+		}
+		os.Exit(1)
+	}
+}
 
-	var serverPort, sourcePort layers.TCPPort = 0, 0
-	var serverSeq, clientSeq uint32 = 0, 0
-	var t0 time.Time
+// selectStreams picks the streams to replay, given the command line options
+func selectStreams(streams []*stream, number int, all bool) ([]*stream, error) {
+	if len(streams) == 0 {
+		return nil, fmt.Errorf("no VNC sessions found")
+	}
 
-	for packet := range packetSource.Packets() {
-		// Get the TCP layer from this packet
-		if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-			// Get actual TCP data from this layer
-			tcp, _ := tcpLayer.(*layers.TCP)
+	if all {
+		return streams, nil
+	} else if number > 0 {
+		if number > len(streams) {
+			return nil, fmt.Errorf("stream %d not found; the capture contains %d VNC sessions", number, len(streams))
+		}
+		return streams[number-1 : number], nil
+	} else if len(streams) > 1 {
+		listStreams(os.Stderr, streams)
+		return nil, fmt.Errorf("the capture contains %d VNC sessions; select one using -stream N, or use -all", len(streams))
+	}
 
-			meta := packet.Metadata()
-			if serverPort == 0 && sourcePort == 0 {
-				// Assume the first packet is the first SYN
-				serverPort, sourcePort = tcp.DstPort, tcp.SrcPort
-				t0 = meta.Timestamp
-			}
+	return streams, nil
+}
 
-			if tcp.SYN {
-				if tcp.SrcPort == serverPort {
-					serverSeq = tcp.Seq + 1
-				} else if tcp.SrcPort == sourcePort {
-					clientSeq = tcp.Seq + 1
-				}
-			}
+// numberedFilename inserts a stream number before the extension of a
+// filename
+func numberedFilename(filename string, number int) string {
+	ext := filepath.Ext(filename)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(filename, ext), number, ext)
+}
 
-			if len(tcp.Payload) == 0 {
-				continue
-			}
+// parseMidStreamOptions parses the display size and pixel format options
+func parseMidStreamOptions(geometry, pixelFormat string) (rfb.MidStreamOptions, error) {
+	var rv rfb.MidStreamOptions
+	if geometry != "" {
+		if _, err := fmt.Sscanf(geometry, "%dx%d", &rv.Width, &rv.Height); err != nil || rv.Width <= 0 || rv.Height <= 0 {
+			return rv, fmt.Errorf("invalid geometry '%s'; expected WIDTHxHEIGHT", geometry)
+		}
+	}
+	if pixelFormat != "" {
+		pf, ok := rfb.StandardPixelFormats[pixelFormat]
+		if !ok {
+			return rv, fmt.Errorf("unknown pixel format '%s'", pixelFormat)
+		}
+		rv.PixelFormat = &pf
+	}
+	return rv, nil
+}
 
-			tpacket := meta.Timestamp.Sub(t0)
+// writeReplay creates an HTML replay of one stream in a capture
+func writeReplay(inFile string, s *stream, outFile string, embedAssets bool, keys secrets, midStream rfb.MidStreamOptions) error {
+	out, err := os.Create(outFile)
+	if err != nil {
+		return err
+	}
+	replay, err := rfb.New(out)
+	if err != nil {
+		return err
+	}
+	replay.EmbedAssets = embedAssets
+	keys.apply(replay)
+	if s.MidStream {
+		replay.MidStream = &midStream
+	}
 
-			err = nil
-			if tcp.SrcPort == serverPort {
-				err = replay.ServerBytes(tpacket, int(tcp.Seq-serverSeq), tcp.Payload)
-			} else if tcp.SrcPort == sourcePort {
-				err = replay.ClientBytes(tpacket, int(tcp.Seq-clientSeq), tcp.Payload)
-			} else {
-				log.Printf("Ignoring extra traffic")
-			}
+	// Ignored segments still leave a replay worth writing
+	if err := readCapture(inFile, s, replay); err != nil {
+		if _, ok := err.(*segmentError); !ok {
+			return err
+		}
+		log.Printf("Warning: stream %d: %s", s.Number, err)
+	}
+	return replay.Close()
+}
+
+// printAuth prints the authentication details of the VNC session in a
+// capture, in formats suitable for password crackers. If a wordlist is
+// supplied, it also tries to recover the password.
+func printAuth(inFile string, s *stream, keys secrets) error {
+	if s.MidStream {
+		fmt.Printf("Session %s -> %s: the capture starts after the handshake\n", s.Client, s.Server)
+		return nil
+	}
+
+	replay, err := rfb.New(discard{})
+	if err != nil {
+		return err
+	}
+	keys.apply(replay)
+
+	if err := readCapture(inFile, s, replay); err != nil {
+		if _, ok := err.(*segmentError); !ok {
+			return err
+		}
+		log.Printf("Warning: stream %d: %s", s.Number, err)
+	}
+
+	auth, err := replay.ReadAuth()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Session %s -> %s, security type %d\n", s.Client, s.Server, auth.SecurityType)
+	if auth.RepeaterID != "" {
+		fmt.Printf("Repeater ID: %s\n", auth.RepeaterID)
+	}
+	if auth.HasVNCAuth() {
+		fmt.Printf("Challenge:  %x\n", auth.Challenge)
+		fmt.Printf("Response:   %x\n", auth.Response)
+		fmt.Printf("\nJohn the Ripper:\n%s\n", auth.John())
+		fmt.Printf("\nHashcat (-m 14000, bit-reversed password as key):\n%s\n", auth.Hashcat())
+		if !auth.PasswordFound && keys.wordlist != nil {
+			fmt.Printf("\nPassword not found in wordlist\n")
+		}
+	} else if !auth.PasswordFound {
+		fmt.Printf("No VNC authentication found\n")
+	}
+
+	if auth.Username != "" || auth.PasswordFound {
+		fmt.Printf("\n")
+	}
+	if auth.Username != "" {
+		fmt.Printf("Username:   %s\n", auth.Username)
+	}
+	if auth.PasswordFound {
+		fmt.Printf("Password:   %s\n", auth.Password)
+	}
+	return nil
+}
+
+// secrets holds the key material used to recover credentials or decrypt a
+// session
+type secrets struct {
+	wordlist      *os.File
+	dhPrivateKeys []*big.Int
+	keyLog        rfb.KeyLog
+	rsaKey        *rsa.PrivateKey
+}
+
+func (s secrets) apply(replay *rfb.RFB) {
+	if s.wordlist != nil {
+		// The wordlist may be used for more than one session
+		s.wordlist.Seek(0, io.SeekStart)
+		replay.Wordlist = s.wordlist
+	}
+	replay.DHPrivateKeys = s.dhPrivateKeys
+	replay.TLSKeyLog = s.keyLog
+	replay.TLSPrivateKey = s.rsaKey
+}
+
+// readKeyLog reads a TLS key log file
+func readKeyLog(filename string) (rfb.KeyLog, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return rfb.ParseKeyLog(f)
+}
+
+// readRSAKey reads a PEM-encoded RSA private key, in either PKCS #1 or
+// PKCS #8 format
+func readRSAKey(filename string) (*rsa.PrivateKey, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			return nil, fmt.Errorf("no RSA private key found in '%s'", filename)
+		}
+
+		if block.Type == "RSA PRIVATE KEY" {
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		} else if block.Type == "PRIVATE KEY" {
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
 			if err != nil {
-				log.Fatal(err)
+				return nil, err
+			}
+			if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+				return rsaKey, nil
 			}
+			return nil, fmt.Errorf("the private key in '%s' is not an RSA key", filename)
+		}
+	}
+}
+
+// parsePrivateKeys parses a comma-separated list of hexadecimal numbers
+func parsePrivateKeys(s string) ([]*big.Int, error) {
+	var rv []*big.Int
+	for _, h := range strings.Split(s, ",") {
+		h = strings.TrimPrefix(strings.TrimSpace(h), "0x")
+		if h == "" {
+			continue
 		}
+		n, ok := new(big.Int).SetString(h, 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid Diffie-Hellman private value '%s'", h)
+		}
+		rv = append(rv, n)
 	}
+	return rv, nil
+}
+
+// discard is an io.WriteCloser that discards everything written to it
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discard) Close() error {
+	return nil
 }
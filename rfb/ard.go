@@ -0,0 +1,115 @@
+package rfb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/md5"
+	"fmt"
+	"html"
+	"math/big"
+)
+
+// consumeARDAuth reads the Apple Remote Desktop authentication exchange
+// (security type 30). The client encrypts the username and password using a
+// key derived from a Diffie-Hellman exchange; if either party's private value
+// is known, they can be decrypted.
+func (rfb *RFB) consumeARDAuth() error {
+	params := rfb.nextS(4)
+	if len(params) != 4 {
+		return fmt.Errorf("handshake failed: ARD parameters truncated")
+	}
+	generator := big.NewInt(int64(rInt(params[0:2])))
+	keyLength := rInt(params[2:4])
+
+	prime := new(big.Int).SetBytes(rfb.nextS(keyLength))
+	serverKey := new(big.Int).SetBytes(rfb.nextS(keyLength))
+
+	credentials := rfb.nextC(128)
+	clientKey := new(big.Int).SetBytes(rfb.nextC(keyLength))
+	if len(credentials) != 128 {
+		return fmt.Errorf("handshake failed: ARD credentials truncated")
+	}
+
+	fmt.Fprintf(rfb.htmlOut, "<div>Apple Remote Desktop authentication: %d-bit Diffie-Hellman, generator %s</div>\n", 8*keyLength, generator)
+
+	secret, err := dhSharedSecret(generator, prime, serverKey, clientKey, rfb.DHPrivateKeys)
+	if err != nil {
+		fmt.Fprintf(rfb.htmlOut, "<div>Not decrypting ARD credentials: %s</div>\n", html.EscapeString(err.Error()))
+		return nil
+	} else if secret == nil {
+		return nil
+	}
+
+	// The AES key is the MD5 hash of the shared secret
+	key := md5.Sum(leftPad(secret.Bytes(), keyLength))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	plain := make([]byte, len(credentials))
+	for i := 0; i < len(credentials); i += aes.BlockSize {
+		block.Decrypt(plain[i:i+aes.BlockSize], credentials[i:i+aes.BlockSize])
+	}
+
+	rfb.auth.Username = cString(plain[0:64])
+	rfb.auth.Password = cString(plain[64:128])
+	rfb.auth.PasswordFound = true
+	fmt.Fprintf(rfb.htmlOut, "<div>ARD credentials decrypted</div>\n")
+
+	return nil
+}
+
+// dhSharedSecret computes the shared secret of a Diffie-Hellman exchange,
+// given the private value of either party. It returns nil if none of the
+// candidate private values match.
+func dhSharedSecret(generator, prime, serverKey, clientKey *big.Int, privateKeys []*big.Int) (*big.Int, error) {
+	if err := dhCheckParameters(prime, serverKey, clientKey); err != nil {
+		return nil, err
+	}
+
+	for _, priv := range privateKeys {
+		pub := new(big.Int).Exp(generator, priv, prime)
+		if pub.Cmp(clientKey) == 0 {
+			return new(big.Int).Exp(serverKey, priv, prime), nil
+		} else if pub.Cmp(serverKey) == 0 {
+			return new(big.Int).Exp(clientKey, priv, prime), nil
+		}
+	}
+	return nil, nil
+}
+
+// dhCheckParameters returns an error if the modulus of a Diffie-Hellman
+// exchange is not greater than 1, or a public value lies outside [2, p-2].
+// Such values either leak the shared secret or make exponentiation
+// meaningless; a modulus of 0 would even have big.Int.Exp compute the full
+// power.
+func dhCheckParameters(prime *big.Int, publicKeys ...*big.Int) error {
+	if prime.Cmp(big.NewInt(1)) <= 0 {
+		return fmt.Errorf("invalid Diffie-Hellman modulus %s", prime)
+	}
+	max := new(big.Int).Sub(prime, big.NewInt(2))
+	for _, pub := range publicKeys {
+		if pub.Cmp(big.NewInt(2)) < 0 || pub.Cmp(max) > 0 {
+			return fmt.Errorf("invalid Diffie-Hellman public value %s", pub)
+		}
+	}
+	return nil
+}
+
+// leftPad pads b with zeroes to length l
+func leftPad(b []byte, l int) []byte {
+	if len(b) >= l {
+		return b
+	}
+	rv := make([]byte, l)
+	copy(rv[l-len(b):], b)
+	return rv
+}
+
+// cString returns the contents of a null-terminated string
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,51 @@
+package rfb
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestDHSharedSecret(t *testing.T) {
+	// p = 1019, g = 2; the client's private value is 123, the server's 456
+	g, p := big.NewInt(2), big.NewInt(1019)
+	clientKey := new(big.Int).Exp(g, big.NewInt(123), p)
+	serverKey := new(big.Int).Exp(g, big.NewInt(456), p)
+	shared := new(big.Int).Exp(clientKey, big.NewInt(456), p)
+
+	tests := []struct {
+		name                 string
+		prime                *big.Int
+		serverKey, clientKey *big.Int
+		privateKeys          []int64
+		want                 *big.Int
+		wantErr              bool
+	}{
+		{"client private value", p, serverKey, clientKey, []int64{123}, shared, false},
+		{"server private value", p, serverKey, clientKey, []int64{456}, shared, false},
+		{"second candidate", p, serverKey, clientKey, []int64{7, 456}, shared, false},
+		{"no match", p, serverKey, clientKey, []int64{7}, nil, false},
+		{"modulus 0", big.NewInt(0), serverKey, clientKey, []int64{123}, nil, true},
+		{"modulus 1", big.NewInt(1), serverKey, clientKey, []int64{123}, nil, true},
+		{"public value 0", p, big.NewInt(0), clientKey, []int64{123}, nil, true},
+		{"public value 1", p, serverKey, big.NewInt(1), []int64{123}, nil, true},
+		{"public value p-1", p, big.NewInt(1018), clientKey, []int64{123}, nil, true},
+		{"public value p", p, serverKey, big.NewInt(1019), []int64{123}, nil, true},
+		{"public value p-2", p, big.NewInt(1017), clientKey, nil, nil, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var priv []*big.Int
+			for _, k := range tc.privateKeys {
+				priv = append(priv, big.NewInt(k))
+			}
+			got, err := dhSharedSecret(g, tc.prime, tc.serverKey, tc.clientKey, priv)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v; want error: %v", err, tc.wantErr)
+			}
+			if (got == nil) != (tc.want == nil) || (got != nil && got.Cmp(tc.want) != 0) {
+				t.Errorf("got %v; want %v", got, tc.want)
+			}
+		})
+	}
+}
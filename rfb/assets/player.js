@@ -3,6 +3,8 @@ class RFB {
 	constructor(width, height) {
 		this.width = width;
 		this.height = height;
+		this.initialWidth = width;
+		this.initialHeight = height;
 		this.tmax = 0.0;
 		this.currentTime = 0.0;
 		this.playing = false;
@@ -13,6 +15,7 @@ class RFB {
 			buttons: { Lmb: 0, Rmb: 0, Mmb: 0, Su: 0, Sd: 0 },
 			indicators: { Lmb: null, Rmb: null, Mmb: null, Su: null, Sd: null },
 			clicks: [],
+			serverMoved: false,
 			skin: {
 				img: null,
 				offsetX: 0,
@@ -24,6 +27,11 @@ class RFB {
 		this.keycaps = null;
 		this.readout = null;
 		this.events = [];
+		this.session = [];
+	}
+
+	SetSessionInfo(label, value) {
+		this.session.push({label, value});
 	}
 
 	PushEvent(type, time, data) {
@@ -48,6 +56,8 @@ class RFB {
 		this.pointer.canvas.width = this.width;
 		this.pointer.ctx = this.pointer.canvas.getContext("2d");
 
+		this.backbuffer = document.createElement("canvas");
+
 		let mousesvg = elt.querySelector(".-vic-iodevices .-vic-mouse svg");
 		if ( mousesvg ) {
 			this.pointer.indicators.Lmb = mousesvg.querySelector(".Lmb");
@@ -63,6 +73,20 @@ class RFB {
 
 		this.readout = elt.querySelector(".-vic-iodevices .-vic-readout");
 
+		this.desktopName = elt.querySelector(".-vic-aab .-vic-desktopname");
+
+		let sessionInfo = elt.querySelector(".-vic-session");
+		if ( sessionInfo ) {
+			for ( let info of this.session ) {
+				let dt = document.createElement("dt");
+				dt.innerText = info.label;
+				let dd = document.createElement("dd");
+				dd.innerText = info.value;
+				sessionInfo.appendChild(dt);
+				sessionInfo.appendChild(dd);
+			}
+		}
+
 		this.powerIndicator = elt.querySelector(".-vic-indicator.-power");
 
 		this.playbutton = elt.querySelector(".-vic-controls .-playpause");
@@ -110,17 +134,20 @@ class RFB {
 
 	Reset() {
 		this.eventIndex = 0;
+		this.setSize(this.initialWidth, this.initialHeight);
 		this.setTime(0);
 		this.ctx.fillStyle = 'rgb( 0, 0, 0 )';
 		this.ctx.fillRect( 0, 0, this.width, this.height );
 
 		this.readout.innerHTML = "";
+		this.desktopName.innerText = "";
 
 		// Get rid of the pointer
 		this.pointer.X = -20;
 		this.pointer.Y = -20;
 		this.pointer.buttons = { Lmb: 0, Rmb: 0, Mmb: 0, Su: 0, Sd: 0 };
 		this.pointer.clicks = [];
+		this.pointer.serverMoved = false;
 		this.blitMouse();
 
 		this.resetKeyboardIndicators();
@@ -226,6 +253,8 @@ class RFB {
 			this.applyFramebuffer(event.data, event.time);
 		} else if ( event.type == "pointerupdate" ) {
 			this.applyPointerUpdate(event.data, event.time);
+		} else if ( event.type == "pointer-position" ) {
+			this.applyPointerPosition(event.data, event.time);
 		} else if ( event.type == "server-cut-text" ) {
 			this.applyCutText(event.data, event.time);
 		} else if ( event.type == "pointer-skin" ) {
@@ -234,6 +263,10 @@ class RFB {
 			this.applyKeyPress(event.data, event.time);
 		} else if ( event.type == "keyrelease" ) {
 			this.applyKeyRelease(event.data, event.time);
+		} else if ( event.type == "desktop-size" ) {
+			this.applyDesktopSize(event.data, event.time);
+		} else if ( event.type == "desktop-name" ) {
+			this.applyDesktopName(event.data, event.time);
 		} else {
 			console.error("Event ", event.type, " has not been implemented");
 		}
@@ -246,6 +279,38 @@ class RFB {
 		}
 	}
 
+	applyDesktopSize(size) {
+		this.setSize(size.Width, size.Height);
+	}
+
+	applyDesktopName(name) {
+		this.desktopName.innerText = name.Name;
+	}
+
+	setSize(width, height) {
+		if ( width == this.width && height == this.height ) {
+			return;
+		}
+
+		// Resizing a canvas clears it, so hang on to its current contents
+		this.backbuffer.width = this.width;
+		this.backbuffer.height = this.height;
+		this.backbuffer.getContext("2d").drawImage(this.canvas, 0, 0);
+
+		this.width = width;
+		this.height = height;
+
+		this.canvas.width = width;
+		this.canvas.height = height;
+		this.ctx.fillStyle = 'rgb( 0, 0, 0 )';
+		this.ctx.fillRect( 0, 0, width, height );
+		this.ctx.drawImage(this.backbuffer, 0, 0);
+
+		this.pointer.canvas.width = width;
+		this.pointer.canvas.height = height;
+		this.resizeSpriteLayer();
+	}
+
 	applyPointerSkin(skin) {
 		if ( skin.Default == 1 ) {
 			this.pointer.skin.img = null;
@@ -276,6 +341,7 @@ class RFB {
 	applyPointerUpdate(pdata, time) {
 		this.pointer.X = pdata.X;
 		this.pointer.Y = pdata.Y;
+		this.pointer.serverMoved = false;
 
 		if ( pdata.Lmb && !this.pointer.buttons.Lmb ) {
 			console.log("Left click");
@@ -289,6 +355,13 @@ class RFB {
 		}
 	}
 
+	applyPointerPosition(pdata) {
+		// The remote side moved the pointer, rather than the user
+		this.pointer.X = pdata.X;
+		this.pointer.Y = pdata.Y;
+		this.pointer.serverMoved = true;
+	}
+
 	applyKeyPress(keyevent) {
 		const keycode = keyevent.Key;
 		this.updateKeyboardIndicator(keycode, 1);
@@ -402,6 +475,10 @@ class RFB {
 			this.drawClick(click);
 		}
 
+		if ( this.pointer.serverMoved ) {
+			this.drawServerMoved();
+		}
+
 		if ( this.pointer.skin.img ) {
 			let x = this.pointer.X - this.pointer.skin.offsetX;
 			let y = this.pointer.Y - this.pointer.skin.offsetY;
@@ -415,6 +492,20 @@ class RFB {
 		}
 	}
 
+	drawServerMoved() {
+		const RADIUS = 12.0;
+
+		this.pointer.ctx.strokeStyle = 'rgba( 30, 120, 255, 0.8 )';
+		this.pointer.ctx.lineWidth = 2;
+		this.pointer.ctx.setLineDash([4, 3]);
+
+		this.pointer.ctx.beginPath();
+		this.pointer.ctx.ellipse(this.pointer.X, this.pointer.Y, RADIUS, RADIUS, 0, 0, Math.PI*2);
+		this.pointer.ctx.stroke();
+
+		this.pointer.ctx.setLineDash([]);
+	}
+
 	drawClick(click) {
 		const DURATION = 800;
 		const MAXWIDTH = 20.0;
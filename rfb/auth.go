@@ -0,0 +1,113 @@
+package rfb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/des"
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+)
+
+// AuthInfo describes the authentication that took place in a captured
+// session
+type AuthInfo struct {
+	// SecurityType is the security type the client chose
+	SecurityType int
+
+	// Challenge and Response contain the VNC authentication exchange, if
+	// the client used VNC authentication
+	Challenge, Response []byte
+
+	// Username contains the username, for security types that send one
+	Username string
+
+	// Password contains the password that produced the response, if it
+	// was recovered
+	Password      string
+	PasswordFound bool
+
+	// RepeaterID contains the ID that was used to route the connection
+	// through an UltraVNC repeater, if any
+	RepeaterID string
+}
+
+// HasVNCAuth returns whether a VNC authentication exchange was captured
+func (a AuthInfo) HasVNCAuth() bool {
+	return len(a.Challenge) == 16 && len(a.Response) == 16
+}
+
+// John formats the VNC authentication exchange in the format used by John
+// the Ripper
+func (a AuthInfo) John() string {
+	if !a.HasVNCAuth() {
+		return ""
+	}
+	return fmt.Sprintf("$vnc$*%X*%X", a.Challenge, a.Response)
+}
+
+// Hashcat formats the VNC authentication exchange for Hashcat's DES mode
+// (-m 14000), as a ciphertext and plaintext block. Note that VNC reverses the
+// bit order of each password byte to obtain the DES key.
+func (a AuthInfo) Hashcat() string {
+	if !a.HasVNCAuth() {
+		return ""
+	}
+	return fmt.Sprintf("%x:%x", a.Response[0:8], a.Challenge[0:8])
+}
+
+// ReadAuth parses the handshake of the captured session, and returns what it
+// reveals about the authentication used. This does not produce a replay.
+func (rfb *RFB) ReadAuth() (AuthInfo, error) {
+	err := rfb.consumeHandshake()
+	return rfb.auth, err
+}
+
+// CheckPassword returns whether password produces the captured VNC
+// authentication response
+func (a AuthInfo) CheckPassword(password string) bool {
+	if !a.HasVNCAuth() {
+		return false
+	}
+
+	// The key is the password, truncated or zero-padded to 8 bytes, with the
+	// bit order of each byte reversed.
+	var key [8]byte
+	copy(key[:], password)
+	for i := range key {
+		key[i] = bits.Reverse8(key[i])
+	}
+
+	block, err := des.NewCipher(key[:])
+	if err != nil {
+		return false
+	}
+
+	var rv [16]byte
+	block.Encrypt(rv[0:8], a.Challenge[0:8])
+	block.Encrypt(rv[8:16], a.Challenge[8:16])
+	return bytes.Equal(rv[:], a.Response)
+}
+
+// Crack tries every password in the wordlist, one per line, against the VNC
+// authentication exchange. It returns whether the password was found.
+func (a *AuthInfo) Crack(wordlist io.Reader) (bool, error) {
+	if !a.HasVNCAuth() {
+		return false, nil
+	}
+
+	scanner := bufio.NewScanner(wordlist)
+	for scanner.Scan() {
+		// The scanner strips one carriage return from each line, but
+		// wordlists that were converted more than once may have more
+		candidate := strings.TrimRight(scanner.Text(), "\r")
+		if a.CheckPassword(candidate) {
+			a.Password = candidate
+			a.PasswordFound = true
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
@@ -0,0 +1,51 @@
+package rfb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCrack(t *testing.T) {
+	// The response to this challenge for the password "secret", computed
+	// using DES with the bit-reversed key ce a6 c6 4e a6 2e 00 00
+	auth := AuthInfo{
+		Challenge: mustHex(t, "00112233445566778899aabbccddeeff"),
+		Response:  mustHex(t, "f19b50471f60f42298e5c0147db50e1e"),
+	}
+
+	tests := []struct {
+		name     string
+		wordlist string
+		want     bool
+	}{
+		{"found", "password\nsecret\nletmein\n", true},
+		{"last line", "password\nsecret", true},
+		{"CRLF", "password\r\nsecret\r\nletmein\r\n", true},
+		{"CRCRLF", "password\r\r\nsecret\r\r\nletmein\r\r\n", true},
+		{"CR at the end", "password\nsecret\r", true},
+		{"truncated to 8 characters", "secret\x00\x00xyz\n", true},
+		{"not found", "password\nSecret\nsecret \n", false},
+		{"empty", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := auth
+			found, err := a.Crack(strings.NewReader(tc.wordlist))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != tc.want || a.PasswordFound != tc.want {
+				t.Fatalf("found: %v; want %v", found, tc.want)
+			}
+			if found && a.Password != "secret" && a.Password != "secret\x00\x00xyz" {
+				t.Errorf("password is %q; want \"secret\"", a.Password)
+			}
+		})
+	}
+
+	// Without a captured exchange, nothing matches
+	if (AuthInfo{}).CheckPassword("secret") {
+		t.Error("password matched without VNC authentication")
+	}
+}
@@ -27,10 +27,19 @@ func (rfb *RFB) consumeClientEvent() error {
 		rfb.pixelFormat = ParsePixelFormat(buf[4:20])
 		fmt.Fprintf(rfb.htmlOut, "<div>Pixel format set to: %s</div>\n", rfb.pixelFormat)
 	} else if messageType == 2 {
-		fmt.Fprintf(rfb.htmlOut, "<div class=\"-todo\">TODO: SetEncodings</div>\n")
 		_ = rfb.nextC(2)
 		nEncs := rInt(rfb.nextC(2))
-		_ = rfb.nextC(4 * nEncs)
+		buf := rfb.nextC(4 * nEncs)
+		encodings := make([]int32, 0, nEncs)
+		for i := 0; i+4 <= len(buf); i += 4 {
+			enc := int32(uint32(rInt(buf[i : i+4])))
+			encodings = append(encodings, enc)
+			if enc >= -32 && enc <= -23 {
+				// JPEG quality level pseudo-encoding
+				rfb.qualityLevel = int(enc + 32)
+			}
+		}
+		fmt.Fprintf(rfb.htmlOut, "<div>Client supports encodings: %v</div>\n", encodings)
 	} else if messageType == 3 {
 		_ = rfb.nextC(10)
 		// fmt.Fprintf(rfb.htmlOut, "<div>Framebuffer Update Request for a %dx%dpx area at %dx%d</div>\n", rInt(buf[2:4]), rInt(buf[4:6]), rInt(buf[6:8]), rInt(buf[8:10]))
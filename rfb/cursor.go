@@ -0,0 +1,69 @@
+package rfb
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// decodeXCursor decodes a cursor shape in the XCursor pseudo-encoding into
+// rv. The cursor consists of two colours, a bitmap that selects between them,
+// and a transparency mask.
+func decodeXCursor(buf []byte, rv *image.RGBA) (int, error) {
+	bounds := rv.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == 0 || h == 0 {
+		return 0, nil
+	}
+
+	lineLength := (w + 7) / 8
+	maskOffset := 6 + h*lineLength
+	rectEnd := maskOffset + h*lineLength
+	if rectEnd > len(buf) {
+		return len(buf), errTruncated
+	}
+
+	primary := color.RGBA{R: buf[0], G: buf[1], B: buf[2], A: 0xff}
+	secondary := color.RGBA{R: buf[3], G: buf[4], B: buf[5], A: 0xff}
+
+	for j := 0; j < h; j++ {
+		for i := 0; i < w; i++ {
+			aByte := j*lineLength + i/8
+			aBit := uint(i & 0x7)
+
+			if (buf[maskOffset+aByte]<<aBit)&0x80 == 0 {
+				continue
+			}
+			c := secondary
+			if (buf[6+aByte]<<aBit)&0x80 != 0 {
+				c = primary
+			}
+			rv.SetRGBA(bounds.Min.X+i, bounds.Min.Y+j, c)
+		}
+	}
+
+	return rectEnd, nil
+}
+
+// decodeAlphaCursor decodes a cursor shape in the Cursor With Alpha
+// pseudo-encoding into rv. Its pixel data are premultiplied RGBA, in an
+// encoding of their own. Only Raw encoding is supported.
+func decodeAlphaCursor(buf []byte, rv *image.RGBA) (int, error) {
+	if len(buf) < 4 {
+		return len(buf), errTruncated
+	}
+	enctype := int32(uint32(rInt(buf[0:4])))
+	if enctype != 0 {
+		return len(buf), fmt.Errorf("alpha cursor in encoding type %d not supported", enctype)
+	}
+
+	bounds := rv.Bounds()
+	l := 4 * bounds.Dx() * bounds.Dy()
+	if 4+l > len(buf) {
+		return len(buf), errTruncated
+	}
+
+	// This happens to be exactly the representation image.RGBA uses
+	copy(rv.Pix, buf[4:4+l])
+	return 4 + l, nil
+}
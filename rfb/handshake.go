@@ -0,0 +1,295 @@
+package rfb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+)
+
+var versionPattern = regexp.MustCompile(`^RFB (\d{3})\.(\d{3})\n$`)
+
+// parseVersion parses a ProtocolVersion message, and returns the minor
+// version of the protocol that it implies. Version numbers other than 3.7
+// and 3.8 are treated as 3.3, except for later 3.x versions that behave
+// like 3.8.
+func parseVersion(buf []byte) (int, error) {
+	m := versionPattern.FindSubmatch(buf)
+	if m == nil {
+		return 0, fmt.Errorf("invalid protocol version string %q", buf)
+	}
+	major, _ := strconv.Atoi(string(m[1]))
+	minor, _ := strconv.Atoi(string(m[2]))
+
+	if major != 3 {
+		log.Printf("Warning: unknown protocol version %d.%d; treating it as 3.3", major, minor)
+		return 3, nil
+	}
+	if minor >= 8 {
+		// This includes Apple's 3.889
+		return 8, nil
+	} else if minor == 7 {
+		return 7, nil
+	}
+	return 3, nil
+}
+
+func (rfb *RFB) consumeHandshake() error {
+	rfb.consumeRepeaterPrologue()
+
+	// Server version
+	serverVersion, err := parseVersion(rfb.nextS(12))
+	if err != nil {
+		return fmt.Errorf("handshake failed: server sent %s", err)
+	}
+
+	// Client version
+	clientVersion, err := parseVersion(rfb.nextC(12))
+	if err != nil {
+		return fmt.Errorf("handshake failed: client sent %s", err)
+	}
+
+	// The client should never pick a higher version than the server's, but
+	// if it does, the server will most likely ignore that.
+	rfb.version = clientVersion
+	if serverVersion < clientVersion {
+		rfb.version = serverVersion
+	}
+	fmt.Fprintf(rfb.htmlOut, "<div>Protocol version 3.%d</div>\n", rfb.version)
+
+	if err := rfb.consumeSecurity(); err == errUnknownSecurity {
+		return rfb.skipToInit()
+	} else if err != nil {
+		return err
+	}
+
+	return rfb.consumeInit()
+}
+
+// errUnknownSecurity signals that the handshake uses a security type that
+// can't be parsed
+var errUnknownSecurity = errors.New("unknown security type")
+
+// consumeSecurity reads the negotiation of the security type, the
+// authentication exchange, and the SecurityResult
+func (rfb *RFB) consumeSecurity() error {
+	var sec int
+	if rfb.version == 3 {
+		// The server decides on the security type
+		sec = rInt(rfb.nextS(4))
+		if sec == 0 {
+			return fmt.Errorf("handshake failed: server refused connection: %s", rfb.readReason())
+		}
+	} else {
+		// Server security types
+		nSecurity := rInt(rfb.nextS(1))
+		if nSecurity == 0 {
+			return fmt.Errorf("handshake failed: server refused connection: %s", rfb.readReason())
+		}
+		_ = rfb.nextS(1 * nSecurity)
+
+		// Client security choice
+		sec = rInt(rfb.nextC(1))
+	}
+	rfb.auth.SecurityType = sec
+
+	if sec == 1 {
+		// No authentication. Only 3.8 sends a SecurityResult in this case.
+		if rfb.version >= 8 {
+			return rfb.consumeSecurityResult()
+		}
+		return nil
+	} else if sec == 2 {
+		// VNC authentication
+		rfb.consumeVNCAuth()
+		return rfb.consumeSecurityResult()
+	} else if sec == 16 {
+		// Tight
+		return rfb.consumeTightSecurity()
+	} else if sec == 18 {
+		// Anonymous TLS. The security type negotiation is repeated inside
+		// the encrypted session.
+		if err := rfb.startTLS(); err != nil {
+			return err
+		}
+		return rfb.consumeSecurity()
+	} else if sec == 19 {
+		// VeNCrypt
+		if err := rfb.consumeVeNCrypt(); err != nil {
+			return err
+		}
+		return rfb.consumeSecurityResult()
+	} else if sec == 30 {
+		// Apple Remote Desktop
+		if err := rfb.consumeARDAuth(); err != nil {
+			return err
+		}
+		return rfb.consumeSecurityResult()
+	} else if sec == 113 {
+		// UltraVNC MS-Logon II
+		if err := rfb.consumeMSLogonII(); err != nil {
+			return err
+		}
+		return rfb.consumeSecurityResult()
+	}
+
+	fmt.Fprintf(rfb.htmlOut, "<div class=\"-todo\">Authentication type %d not implemented - skipping to ServerInit</div>\n", sec)
+	return errUnknownSecurity
+}
+
+// consumeVNCAuth reads a VNC authentication challenge and response
+func (rfb *RFB) consumeVNCAuth() {
+	rfb.auth.Challenge = rfb.nextS(16)
+	rfb.auth.Response = rfb.nextC(16)
+	fmt.Fprintf(rfb.htmlOut, "<div>VNC authentication: challenge <tt>%x</tt>, response <tt>%x</tt></div>\n", rfb.auth.Challenge, rfb.auth.Response)
+	if rfb.Wordlist != nil {
+		if found, err := rfb.auth.Crack(rfb.Wordlist); err != nil {
+			log.Printf("Error reading wordlist: %s", err)
+		} else if found {
+			fmt.Fprintf(rfb.htmlOut, "<div>VNC password found in wordlist</div>\n")
+		} else {
+			fmt.Fprintf(rfb.htmlOut, "<div>VNC password not found in wordlist</div>\n")
+		}
+	}
+}
+
+// skipToInit skips over any handshake messages that can't be parsed, by
+// searching for a plausible ServerInit message in the server stream. The
+// client's last message before that will have been its ClientInit.
+func (rfb *RFB) skipToInit() error {
+	buf := rfb.serverBuffer.Peek(rfb.serverBuffer.Remaining())
+	offset := -1
+	for i := range buf {
+		if plausibleServerInit(buf[i:]) {
+			offset = i
+			break
+		}
+	}
+	if offset < 0 {
+		return fmt.Errorf("handshake failed: unable to find ServerInit")
+	}
+
+	log.Printf("Skipping %d bytes of unknown handshake messages", offset)
+	rfb.nextS(offset)
+	tInit := rfb.serverBuffer.CurrentTime()
+	rfb.clientBuffer.SkipUntil(tInit)
+
+	return rfb.consumeServerInit()
+}
+
+// plausibleServerInit returns whether buf looks like it starts with a
+// ServerInit message
+func plausibleServerInit(buf []byte) bool {
+	if len(buf) < 24 {
+		return false
+	}
+
+	width, height := rInt(buf[0:2]), rInt(buf[2:4])
+	if width == 0 || height == 0 || width > 16384 || height > 16384 {
+		return false
+	}
+	if !plausiblePixelFormat(buf[4:20]) {
+		return false
+	}
+
+	nlen := rInt(buf[20:24])
+	if nlen > 1024 || 24+nlen > len(buf) {
+		return false
+	}
+	for _, c := range buf[24 : 24+nlen] {
+		if c < 0x20 && c != '\t' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// plausiblePixelFormat returns whether buf contains a sensible pixel format
+func plausiblePixelFormat(buf []byte) bool {
+	bits, depth := buf[0], buf[1]
+	if bits != 8 && bits != 16 && bits != 32 {
+		return false
+	}
+	if depth == 0 || depth > bits {
+		return false
+	}
+	if buf[2] > 1 || buf[3] > 1 {
+		return false
+	}
+	if buf[3] == 1 {
+		// True colour: each maximum must be a power of two minus one
+		pf := ParsePixelFormat(buf)
+		for _, max := range []uint{pf.RedMax, pf.GreenMax, pf.BlueMax} {
+			if max == 0 || max&(max+1) != 0 {
+				return false
+			}
+		}
+		for _, shift := range []uint{pf.RedShift, pf.GreenShift, pf.BlueShift} {
+			if shift >= uint(bits) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// consumeSecurityResult reads the SecurityResult message
+func (rfb *RFB) consumeSecurityResult() error {
+	securityResult := rInt(rfb.nextS(4))
+	if securityResult != 0 {
+		if rfb.version >= 8 {
+			return fmt.Errorf("handshake failed: authentication failed: error %d: %s", securityResult, rfb.readReason())
+		}
+		return fmt.Errorf("handshake failed: authentication failed: error %d", securityResult)
+	}
+	return nil
+}
+
+// readReason reads a failure reason string from the server
+func (rfb *RFB) readReason() string {
+	l := rInt(rfb.nextS(4))
+	if l > rfb.serverBuffer.Remaining() {
+		log.Printf("Warning: implausible reason length %d", l)
+		l = rfb.serverBuffer.Remaining()
+	}
+	return string(rfb.nextS(l))
+}
+
+// consumeInit reads the ClientInit and ServerInit messages
+func (rfb *RFB) consumeInit() error {
+	// Client init
+	cInit := rfb.nextC(1)
+	if len(cInit) != 1 {
+		return fmt.Errorf("handshake failed: client rejected")
+	}
+
+	return rfb.consumeServerInit()
+}
+
+// consumeServerInit reads the ServerInit message
+func (rfb *RFB) consumeServerInit() error {
+
+	// The 'start time' of the replay will be the time at which the final packet in the handshake is sent
+	rfb.timeOffset = floatTime(rfb.serverBuffer.CurrentTime())
+
+	// Server init
+	sInit := rfb.nextS(24)
+	if len(sInit) != 24 {
+		return fmt.Errorf("handshake failed: server rejected")
+	}
+	rfb.width = rInt(sInit[0:2])
+	rfb.height = rInt(sInit[2:4])
+	rfb.pixelFormat = ParsePixelFormat(sInit[4:20])
+	fmt.Fprintf(rfb.htmlOut, "<div>Remote display %dx%d, %s</div>\n", rfb.width, rfb.height, rfb.pixelFormat)
+	fmt.Fprintf(rfb.jsOut, "\n\nlet rfb = new RFB( %d, %d );\n\n", rfb.width, rfb.height)
+	nlen := rInt(sInit[20:24])
+	if nlen > 0 {
+		rfb.name = string(rfb.nextS(nlen))
+		fmt.Fprintf(rfb.htmlOut, "<div>Server name: %s</div>\n", rfb.name)
+		rfb.pushEvent("desktop-name", rfb.serverBuffer.CurrentTime(), desktopName{Name: rfb.name})
+	}
+
+	return rfb.consumeTightInteraction()
+}
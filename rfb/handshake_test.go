@@ -0,0 +1,159 @@
+package rfb
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testOutput collects the HTML output of a replay
+type testOutput struct {
+	bytes.Buffer
+}
+
+func (*testOutput) Close() error {
+	return nil
+}
+
+func TestHandshake(t *testing.T) {
+	challenge := bytes.Repeat([]byte{0xc1}, 16)
+	response := bytes.Repeat([]byte{0x5e}, 16)
+	// A 640x480 rgb888 display called "test"
+	serverInit := concat([]byte{0x02, 0x80, 0x01, 0xe0, 32, 24, 0, 1, 0, 255, 0, 255, 0, 255, 16, 8, 0, 0, 0, 0}, []byte{0, 0, 0, 4}, []byte("test"))
+	ok := []byte{0, 0, 0, 0}
+	failed := []byte{0, 0, 0, 1}
+	reason := concat([]byte{0, 0, 0, 7}, []byte("go away"))
+
+	tests := []struct {
+		name           string
+		server, client []byte
+		wantVersion    int
+		wantSecurity   int
+		wantChallenge  bool
+		wantErr        bool
+	}{
+		{
+			"3.3 without authentication",
+			concat([]byte("RFB 003.003\n"), []byte{0, 0, 0, 1}, serverInit),
+			concat([]byte("RFB 003.003\n"), []byte{1}),
+			3, 1, false, false,
+		},
+		{
+			"3.3 VNC authentication",
+			concat([]byte("RFB 003.003\n"), []byte{0, 0, 0, 2}, challenge, ok, serverInit),
+			concat([]byte("RFB 003.003\n"), response, []byte{1}),
+			3, 2, true, false,
+		},
+		{
+			"3.3 refused",
+			concat([]byte("RFB 003.003\n"), []byte{0, 0, 0, 0}, reason),
+			[]byte("RFB 003.003\n"),
+			3, 0, false, true,
+		},
+		{
+			"3.3 authentication failed",
+			concat([]byte("RFB 003.003\n"), []byte{0, 0, 0, 2}, challenge, failed),
+			concat([]byte("RFB 003.003\n"), response),
+			3, 2, true, true,
+		},
+		{
+			"3.7 without authentication",
+			concat([]byte("RFB 003.007\n"), []byte{2, 1, 2}, serverInit),
+			concat([]byte("RFB 003.007\n"), []byte{1}, []byte{1}),
+			7, 1, false, false,
+		},
+		{
+			"3.7 VNC authentication",
+			concat([]byte("RFB 003.007\n"), []byte{2, 1, 2}, challenge, ok, serverInit),
+			concat([]byte("RFB 003.007\n"), []byte{2}, response, []byte{1}),
+			7, 2, true, false,
+		},
+		{
+			"3.7 refused",
+			concat([]byte("RFB 003.007\n"), []byte{0}, reason),
+			[]byte("RFB 003.007\n"),
+			7, 0, false, true,
+		},
+		{
+			"3.7 authentication failed",
+			concat([]byte("RFB 003.007\n"), []byte{1, 2}, challenge, failed),
+			concat([]byte("RFB 003.007\n"), []byte{2}, response),
+			7, 2, true, true,
+		},
+		{
+			"3.8 without authentication",
+			concat([]byte("RFB 003.008\n"), []byte{2, 1, 2}, ok, serverInit),
+			concat([]byte("RFB 003.008\n"), []byte{1}, []byte{1}),
+			8, 1, false, false,
+		},
+		{
+			"3.8 VNC authentication",
+			concat([]byte("RFB 003.008\n"), []byte{1, 2}, challenge, ok, serverInit),
+			concat([]byte("RFB 003.008\n"), []byte{2}, response, []byte{1}),
+			8, 2, true, false,
+		},
+		{
+			"3.8 authentication failed",
+			concat([]byte("RFB 003.008\n"), []byte{1, 2}, challenge, failed, reason),
+			concat([]byte("RFB 003.008\n"), []byte{2}, response),
+			8, 2, true, true,
+		},
+		{
+			"3.8 server, 3.7 client",
+			concat([]byte("RFB 003.008\n"), []byte{1, 2}, challenge, ok, serverInit),
+			concat([]byte("RFB 003.007\n"), []byte{2}, response, []byte{1}),
+			7, 2, true, false,
+		},
+		{
+			"Apple 3.889",
+			concat([]byte("RFB 003.889\n"), []byte{1, 2}, challenge, ok, serverInit),
+			concat([]byte("RFB 003.889\n"), []byte{2}, response, []byte{1}),
+			8, 2, true, false,
+		},
+		{
+			"invalid version",
+			[]byte("SSH-2.0-Open"),
+			[]byte("RFB 003.008\n"),
+			0, 0, false, true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rfb, err := New(&testOutput{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rfb.serverBuffer.Add(0, 0, tc.server)
+			rfb.clientBuffer.Add(0, 0, tc.client)
+
+			auth, err := rfb.ReadAuth()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v; want error: %v", err, tc.wantErr)
+			}
+			if rfb.version != tc.wantVersion {
+				t.Errorf("version is 3.%d; want 3.%d", rfb.version, tc.wantVersion)
+			}
+			if auth.SecurityType != tc.wantSecurity {
+				t.Errorf("security type is %d; want %d", auth.SecurityType, tc.wantSecurity)
+			}
+			if auth.HasVNCAuth() != tc.wantChallenge {
+				t.Errorf("VNC authentication found: %v; want %v", auth.HasVNCAuth(), tc.wantChallenge)
+			} else if tc.wantChallenge && (!bytes.Equal(auth.Challenge, challenge) || !bytes.Equal(auth.Response, response)) {
+				t.Errorf("challenge %x, response %x; want %x, %x", auth.Challenge, auth.Response, challenge, response)
+			}
+			if err != nil {
+				return
+			}
+
+			if rfb.width != 640 || rfb.height != 480 || rfb.name != "test" {
+				t.Errorf("display is %dx%d %q; want 640x480 \"test\"", rfb.width, rfb.height, rfb.name)
+			}
+			if rfb.pixelFormat != StandardPixelFormats["rgb888"] {
+				t.Errorf("pixel format is %s; want rgb888", rfb.pixelFormat)
+			}
+			if rfb.serverBuffer.Remaining() != 0 || rfb.clientBuffer.Remaining() != 0 {
+				t.Errorf("%d server and %d client bytes left", rfb.serverBuffer.Remaining(), rfb.clientBuffer.Remaining())
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package rfb
+
+import (
+	"image"
+	"image/color"
+)
+
+// Hextile subencoding flags
+const (
+	hextileRaw                 = 1
+	hextileBackgroundSpecified = 2
+	hextileForegroundSpecified = 4
+	hextileAnySubrects         = 8
+	hextileSubrectsColoured    = 16
+)
+
+// decodeHextile decodes a rectangle in Hextile encoding into rv. The
+// rectangle is divided into 16x16 tiles, each of which has its own
+// subencoding. Background and foreground colours carry over from one tile to
+// the next unless they are specified again.
+func (ppf PixelFormat) decodeHextile(buf []byte, rv *image.RGBA) (int, error) {
+	bpp := ppf.BytesPerPixel()
+	bounds := rv.Bounds()
+	offset := 0
+
+	var bg, fg color.RGBA
+
+	for ty := bounds.Min.Y; ty < bounds.Max.Y; ty += 16 {
+		for tx := bounds.Min.X; tx < bounds.Max.X; tx += 16 {
+			tile := image.Rect(tx, ty, tx+16, ty+16).Intersect(bounds)
+
+			if offset >= len(buf) {
+				return len(buf), errTruncated
+			}
+			subenc := buf[offset]
+			offset++
+
+			if subenc&hextileRaw != 0 {
+				n, err := ppf.decodeRawTile(buf[offset:], rv, tile)
+				offset += n
+				if err != nil {
+					return offset, err
+				}
+				continue
+			}
+
+			if subenc&hextileBackgroundSpecified != 0 {
+				if offset+bpp > len(buf) {
+					return len(buf), errTruncated
+				}
+				_, bg = ppf.ReadPixel(buf[offset:])
+				offset += bpp
+			}
+			fillRect(rv, tile, bg)
+
+			if subenc&hextileForegroundSpecified != 0 {
+				if offset+bpp > len(buf) {
+					return len(buf), errTruncated
+				}
+				_, fg = ppf.ReadPixel(buf[offset:])
+				offset += bpp
+			}
+
+			if subenc&hextileAnySubrects == 0 {
+				continue
+			}
+
+			if offset >= len(buf) {
+				return len(buf), errTruncated
+			}
+			nSubrects := int(buf[offset])
+			offset++
+
+			coloured := subenc&hextileSubrectsColoured != 0
+			for i := 0; i < nSubrects; i++ {
+				c := fg
+				if coloured {
+					if offset+bpp > len(buf) {
+						return len(buf), errTruncated
+					}
+					_, c = ppf.ReadPixel(buf[offset:])
+					offset += bpp
+				}
+				if offset+2 > len(buf) {
+					return len(buf), errTruncated
+				}
+				xy, wh := buf[offset], buf[offset+1]
+				offset += 2
+
+				sx, sy := int(xy>>4), int(xy&0xf)
+				sw, sh := int(wh>>4)+1, int(wh&0xf)+1
+				fillRect(rv, image.Rect(sx, sy, sx+sw, sy+sh).Add(tile.Min), c)
+			}
+		}
+	}
+
+	return offset, nil
+}
+
+// decodeRawTile reads raw pixel data for the rectangle r into img
+func (ppf PixelFormat) decodeRawTile(buf []byte, img *image.RGBA, r image.Rectangle) (int, error) {
+	bpp := ppf.BytesPerPixel()
+	if r.Dx()*r.Dy()*bpp > len(buf) {
+		return len(buf), errTruncated
+	}
+
+	offset := 0
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			n, c := ppf.ReadPixel(buf[offset:])
+			offset += n
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return offset, nil
+}
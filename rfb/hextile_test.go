@@ -0,0 +1,112 @@
+package rfb
+
+import (
+	"image"
+	"strings"
+	"testing"
+)
+
+// pixels encodes a picture, given as a string of characters from
+// testColours, in the rgb888 pixel format
+func pixels(picture string) []byte {
+	var rv []byte
+	for i := range picture {
+		rv = append(rv, px(picture[i])...)
+	}
+	return rv
+}
+
+func TestHextile(t *testing.T) {
+	// The 20x3 rectangle consists of a 16x3 and a 4x3 tile
+	tests := []struct {
+		name    string
+		buf     []byte
+		picture []string
+		wantErr error
+	}{
+		{
+			"background carries over",
+			concat([]byte{hextileBackgroundSpecified}, px('r'), []byte{0}),
+			[]string{
+				"rrrrrrrrrrrrrrrr" + "rrrr",
+				"rrrrrrrrrrrrrrrr" + "rrrr",
+				"rrrrrrrrrrrrrrrr" + "rrrr",
+			},
+			nil,
+		},
+		{
+			"foreground subrectangles",
+			concat(
+				[]byte{hextileBackgroundSpecified | hextileForegroundSpecified | hextileAnySubrects}, px('r'), px('b'), []byte{1, 0x10, 0x21},
+				[]byte{hextileAnySubrects, 1, 0x01, 0x00},
+			),
+			[]string{
+				"rbbbrrrrrrrrrrrr" + "rrrr",
+				"rbbbrrrrrrrrrrrr" + "brrr",
+				"rrrrrrrrrrrrrrrr" + "rrrr",
+			},
+			nil,
+		},
+		{
+			"coloured subrectangles",
+			concat(
+				[]byte{hextileBackgroundSpecified | hextileAnySubrects | hextileSubrectsColoured}, px('k'), []byte{2},
+				px('g'), []byte{0x00, 0x00}, px('w'), []byte{0xf2, 0x00},
+				[]byte{hextileRaw}, pixels("rgbw"+"wbgr"+"kkkk"),
+			),
+			[]string{
+				"gkkkkkkkkkkkkkkk" + "rgbw",
+				"kkkkkkkkkkkkkkkk" + "wbgr",
+				"kkkkkkkkkkkkkkkw" + "kkkk",
+			},
+			nil,
+		},
+		{
+			"raw",
+			concat(
+				[]byte{hextileRaw}, pixels(strings.Repeat("rg", 8)+strings.Repeat("gb", 8)+strings.Repeat("bw", 8)),
+				[]byte{hextileRaw}, pixels("wwww"+"kkkk"+"wwww"),
+			),
+			[]string{
+				"rgrgrgrgrgrgrgrg" + "wwww",
+				"gbgbgbgbgbgbgbgb" + "kkkk",
+				"bwbwbwbwbwbwbwbw" + "wwww",
+			},
+			nil,
+		},
+		{
+			"missing tile",
+			concat([]byte{hextileBackgroundSpecified}, px('r')),
+			nil,
+			errTruncated,
+		},
+		{
+			"truncated subrectangle",
+			concat([]byte{hextileBackgroundSpecified | hextileAnySubrects}, px('r'), []byte{2, 0x00, 0x00, 0x11}),
+			nil,
+			errTruncated,
+		},
+		{
+			"truncated raw tile",
+			concat([]byte{hextileRaw}, pixels("rgbw")),
+			nil,
+			errTruncated,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			img := image.NewRGBA(image.Rect(5, 5, 25, 8))
+			n, err := StandardPixelFormats["rgb888"].decodeHextile(tc.buf, img)
+			if err != tc.wantErr {
+				t.Fatalf("got error %v; want %v", err, tc.wantErr)
+			}
+			if n != len(tc.buf) {
+				t.Errorf("consumed %d bytes; want %d", n, len(tc.buf))
+			}
+			if err == nil {
+				checkPicture(t, img, tc.picture)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package rfb
+
+import (
+	"fmt"
+	"log"
+)
+
+// MidStreamOptions describe a session whose capture starts after the
+// handshake. Since the ServerInit message is missing, the display size and
+// pixel format have to come from elsewhere.
+type MidStreamOptions struct {
+	// Width and Height are the size of the remote display. If they are
+	// zero, they are inferred from the first Raw rectangle.
+	Width, Height int
+
+	// PixelFormat is the pixel format used by the server. If it is nil, it
+	// is inferred from the first Raw rectangle, assuming a standard true
+	// colour format.
+	PixelFormat *PixelFormat
+}
+
+// A Direction is the side of a connection that sent some data
+type Direction int
+
+// Directions
+const (
+	DirectionUnknown Direction = iota
+	DirectionClient
+	DirectionServer
+)
+
+// GuessDirection guesses which side of a VNC connection sent a TCP segment,
+// judging by the messages it contains. This is only meaningful for segments
+// sent after the handshake.
+func GuessDirection(segment []byte) Direction {
+	if plausibleClientMessages(segment, 0, 0, -1) {
+		return DirectionClient
+	} else if plausibleFramebufferUpdate(segment, 0, 0) {
+		return DirectionServer
+	}
+	return DirectionUnknown
+}
+
+// knownEncodings contains the encodings and pseudo-encodings that nextRect
+// can decode
+var knownEncodings = map[int32]bool{
+	0: true, 1: true, 2: true, 4: true, 5: true, 6: true, 7: true, 15: true, 16: true, 17: true,
+	-223: true, -224: true, -232: true, -239: true, -240: true, -307: true, -308: true, -314: true,
+}
+
+// withinDisplay returns whether a rectangle fits on a display of the given
+// size. A zero width or height means that the size is unknown.
+func withinDisplay(x, y, w, h, width, height int) bool {
+	if width == 0 || height == 0 {
+		width, height = 16384, 16384
+	}
+	return x+w <= width && y+h <= height
+}
+
+// plausibleFramebufferUpdate returns whether buf looks like it starts with a
+// FramebufferUpdate message
+func plausibleFramebufferUpdate(buf []byte, width, height int) bool {
+	if len(buf) < 16 || buf[0] != 0 || buf[1] != 0 {
+		return false
+	}
+	if rInt(buf[2:4]) == 0 {
+		return false
+	}
+	return plausibleRectHeader(buf[4:16], width, height)
+}
+
+// plausibleRectHeader returns whether buf contains a sensible rectangle
+// header
+func plausibleRectHeader(buf []byte, width, height int) bool {
+	x, y, w, h := rInt(buf[0:2]), rInt(buf[2:4]), rInt(buf[4:6]), rInt(buf[6:8])
+	enctype := int32(uint32(rInt(buf[8:12])))
+	if !knownEncodings[enctype] {
+		return false
+	}
+	if enctype < 0 {
+		// Pseudo-encodings use the coordinates for other purposes
+		return true
+	}
+	return w > 0 && h > 0 && withinDisplay(x, y, w, h, width, height)
+}
+
+// clientMessageLength returns the length of the client message at the start
+// of buf, or 0 if it isn't a plausible and complete message
+func clientMessageLength(buf []byte, width, height int) int {
+	if len(buf) == 0 {
+		return 0
+	}
+
+	switch buf[0] {
+	case 0:
+		// SetPixelFormat
+		if len(buf) >= 20 && rInt(buf[1:4]) == 0 && plausiblePixelFormat(buf[4:20]) {
+			return 20
+		}
+	case 2:
+		// SetEncodings
+		if len(buf) >= 4 && buf[1] == 0 {
+			n := rInt(buf[2:4])
+			if n > 0 && n <= 64 && len(buf) >= 4+4*n {
+				return 4 + 4*n
+			}
+		}
+	case 3:
+		// FramebufferUpdateRequest
+		if len(buf) >= 10 && buf[1] <= 1 {
+			x, y, w, h := rInt(buf[2:4]), rInt(buf[4:6]), rInt(buf[6:8]), rInt(buf[8:10])
+			if w > 0 && h > 0 && withinDisplay(x, y, w, h, width, height) {
+				return 10
+			}
+		}
+	case 4:
+		// KeyEvent
+		if len(buf) >= 8 && buf[1] <= 1 && rInt(buf[2:4]) == 0 && rInt(buf[4:8]) != 0 {
+			return 8
+		}
+	case 5:
+		// PointerEvent
+		if len(buf) >= 6 && withinDisplay(rInt(buf[2:4]), rInt(buf[4:6]), 1, 1, width, height) {
+			return 6
+		}
+	case 6:
+		// ClientCutText
+		if len(buf) >= 8 && rInt(buf[1:4]) == 0 {
+			l := rInt(buf[4:8])
+			if l <= 1<<20 && len(buf) >= 8+l {
+				return 8 + l
+			}
+		}
+	}
+
+	return 0
+}
+
+// plausibleClientMessages returns whether buf starts with n plausible client
+// messages, or consists of fewer than n that end exactly at the end of buf.
+// If n is negative, all of buf must consist of client messages.
+func plausibleClientMessages(buf []byte, width, height, n int) bool {
+	offset := 0
+	for i := 0; n < 0 || i < n; i++ {
+		if offset == len(buf) {
+			return i > 0
+		}
+		l := clientMessageLength(buf[offset:], width, height)
+		if l == 0 {
+			return false
+		}
+		offset += l
+	}
+	return true
+}
+
+// inferDisplay tries to infer the display size and pixel format from the
+// first Raw rectangle in a FramebufferUpdate, by finding the pixel size for
+// which the data that follows it makes sense
+func inferDisplay(buf []byte) (width, height int, pf PixelFormat, ok bool) {
+	for offset := 0; offset+16 <= len(buf); offset++ {
+		if !plausibleFramebufferUpdate(buf[offset:], 0, 0) || rInt(buf[offset+12:offset+16]) != 0 {
+			continue
+		}
+
+		nRects := rInt(buf[offset+2 : offset+4])
+		x, y := rInt(buf[offset+4:offset+6]), rInt(buf[offset+6:offset+8])
+		w, h := rInt(buf[offset+8:offset+10]), rInt(buf[offset+10:offset+12])
+		for _, name := range []string{"rgb888", "rgb565", "bgr233"} {
+			pf := StandardPixelFormats[name]
+			next := offset + 16 + w*h*pf.BytesPerPixel()
+			if next > len(buf) {
+				continue
+			}
+
+			var plausible bool
+			if next == len(buf) {
+				plausible = true
+			} else if nRects > 1 {
+				plausible = next+12 <= len(buf) && plausibleRectHeader(buf[next:next+12], 0, 0)
+			} else {
+				plausible = buf[next] <= 3
+			}
+			if plausible {
+				return x + w, y + h, pf, true
+			}
+		}
+	}
+
+	return 0, 0, PixelFormat{}, false
+}
+
+// requestedArea returns the extent of the largest area covered by the
+// FramebufferUpdateRequests in a series of client messages
+func requestedArea(buf []byte) (width, height int) {
+	for offset := 0; offset < len(buf); {
+		l := clientMessageLength(buf[offset:], 0, 0)
+		if l == 0 {
+			break
+		}
+		if buf[offset] == 3 {
+			x, y := rInt(buf[offset+2:offset+4]), rInt(buf[offset+4:offset+6])
+			w, h := rInt(buf[offset+6:offset+8]), rInt(buf[offset+8:offset+10])
+			if x+w > width {
+				width = x + w
+			}
+			if y+h > height {
+				height = y + h
+			}
+		}
+		offset += l
+	}
+	return width, height
+}
+
+// resync prepares the replay of a session whose capture starts after the
+// handshake. It skips to the first plausible message boundary in both
+// streams, and sets up the state the ServerInit message would have.
+func (rfb *RFB) resync() error {
+	rfb.version = 8
+	rfb.width, rfb.height = rfb.MidStream.Width, rfb.MidStream.Height
+
+	serverSkip := rfb.serverBuffer.Find(func(buf []byte) bool {
+		return plausibleFramebufferUpdate(buf, rfb.width, rfb.height)
+	})
+	if serverSkip < 0 {
+		return fmt.Errorf("unable to find a FramebufferUpdate in the server stream")
+	}
+	rfb.nextS(serverSkip)
+
+	clientSkip := rfb.clientBuffer.Find(func(buf []byte) bool {
+		return plausibleClientMessages(buf, rfb.width, rfb.height, 4)
+	})
+	if clientSkip < 0 {
+		log.Printf("Warning: unable to find a client message; ignoring the client stream")
+		clientSkip = rfb.clientBuffer.Remaining()
+	}
+	rfb.nextC(clientSkip)
+
+	var inferred bool
+	if rfb.width == 0 || rfb.height == 0 || rfb.MidStream.PixelFormat == nil {
+		width, height, pf, ok := inferDisplay(rfb.serverBuffer.Peek(rfb.serverBuffer.Remaining()))
+
+		// Requests for a full update usually cover the entire display
+		requestWidth, requestHeight := requestedArea(rfb.clientBuffer.Peek(rfb.clientBuffer.Remaining()))
+		if requestWidth > width {
+			width = requestWidth
+		}
+		if requestHeight > height {
+			height = requestHeight
+		}
+
+		if rfb.width == 0 || rfb.height == 0 {
+			if width == 0 || height == 0 {
+				return fmt.Errorf("unable to infer the display size; please specify it")
+			}
+			rfb.width, rfb.height = width, height
+			inferred = true
+		}
+		if rfb.MidStream.PixelFormat != nil {
+			rfb.pixelFormat = *rfb.MidStream.PixelFormat
+		} else if ok {
+			rfb.pixelFormat = pf
+			inferred = true
+		} else {
+			log.Printf("Warning: unable to infer the pixel format; assuming 32-bit true colour")
+			rfb.pixelFormat = StandardPixelFormats["rgb888"]
+		}
+	} else {
+		rfb.pixelFormat = *rfb.MidStream.PixelFormat
+	}
+
+	rfb.timeOffset = floatTime(rfb.serverBuffer.CurrentTime())
+	if rfb.clientBuffer.Remaining() > 0 && rfb.clientBuffer.CurrentTime() < rfb.serverBuffer.CurrentTime() {
+		rfb.timeOffset = floatTime(rfb.clientBuffer.CurrentTime())
+	}
+
+	fmt.Fprintf(rfb.htmlOut, "<div>Capture starts mid-stream: skipped %d server bytes and %d client bytes</div>\n", serverSkip, clientSkip)
+	if inferred {
+		fmt.Fprintf(rfb.htmlOut, "<div>Display size or pixel format inferred from the captured messages</div>\n")
+	}
+	fmt.Fprintf(rfb.htmlOut, "<div>Remote display %dx%d, %s</div>\n", rfb.width, rfb.height, rfb.pixelFormat)
+	fmt.Fprintf(rfb.jsOut, "\n\nlet rfb = new RFB( %d, %d );\n\n", rfb.width, rfb.height)
+
+	return nil
+}
@@ -38,13 +38,19 @@ func (p PixelFormat) BytesPerPixel() int {
 }
 
 func (p PixelFormat) ReadPixel(buf []byte) (int, color.RGBA) {
+	l, pixel := p.readPixelValue(buf)
+	return l, p.colour(pixel)
+}
+
+// readPixelValue reads the raw value of a single pixel from buf
+func (p PixelFormat) readPixelValue(buf []byte) (int, uint) {
 	l := (p.Bits + 7) / 8
 	var pixel uint = 0
 	if l == 1 {
 		pixel = uint(buf[0])
 	} else if p.BigEndian {
 		for i := 0; i < l; i++ {
-			pixel = pixel<<8 | uint(buf[0])
+			pixel = pixel<<8 | uint(buf[i])
 		}
 	} else {
 		for i := 0; i < l; i++ {
@@ -52,18 +58,36 @@ func (p PixelFormat) ReadPixel(buf []byte) (int, color.RGBA) {
 		}
 	}
 
+	return l, pixel
+}
+
+// colour converts a raw pixel value to its colour
+func (p PixelFormat) colour(pixel uint) color.RGBA {
 	r := (pixel >> p.RedShift) & p.RedMax
 	g := (pixel >> p.GreenShift) & p.GreenMax
 	b := (pixel >> p.BlueShift) & p.BlueMax
 
-	return l, color.RGBA{
-		R: uint8((r * 0xff) / p.RedMax),
-		G: uint8((g * 0xff) / p.GreenMax),
-		B: uint8((b * 0xff) / p.BlueMax),
+	return color.RGBA{
+		R: scaleComponent(r, p.RedMax),
+		G: scaleComponent(g, p.GreenMax),
+		B: scaleComponent(b, p.BlueMax),
 		A: 0xff,
 	}
 }
 
+// colourMask returns the bits in a pixel value that contribute to its colour
+func (p PixelFormat) colourMask() uint {
+	return p.RedMax<<p.RedShift | p.GreenMax<<p.GreenShift | p.BlueMax<<p.BlueShift
+}
+
+// scaleComponent scales a colour component with maximum value max to 8 bits
+func scaleComponent(c, max uint) uint8 {
+	if max == 0 {
+		return 0
+	}
+	return uint8((c * 0xff) / max)
+}
+
 func (p PixelFormat) String() string {
 	if p.TrueColour {
 		return fmt.Sprintf("%d-bit true colour", p.Bits)
@@ -71,3 +95,12 @@ func (p PixelFormat) String() string {
 		return fmt.Sprintf("%d-bit mapped", p.Bits)
 	}
 }
+
+// StandardPixelFormats contains commonly used little-endian true colour
+// pixel formats, by name
+var StandardPixelFormats = map[string]PixelFormat{
+	"rgb888": {Bits: 32, Depth: 24, TrueColour: true, RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8, BlueShift: 0},
+	"rgb565": {Bits: 16, Depth: 16, TrueColour: true, RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5, BlueShift: 0},
+	"rgb555": {Bits: 16, Depth: 15, TrueColour: true, RedMax: 31, GreenMax: 31, BlueMax: 31, RedShift: 10, GreenShift: 5, BlueShift: 0},
+	"bgr233": {Bits: 8, Depth: 8, TrueColour: true, RedMax: 7, GreenMax: 7, BlueMax: 3, RedShift: 0, GreenShift: 3, BlueShift: 6},
+}
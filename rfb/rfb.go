@@ -2,17 +2,33 @@ package rfb
 
 import (
 	"bytes"
+	"crypto/rsa"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
 	"io"
 	"log"
+	"math/big"
 	"time"
 )
 
 // An RFB represents a captured VNC session
 type RFB struct {
 	// EmbedAssets controls whether static assets should be linked or embedded in the output HTML
-	EmbedAssets  bool
+	EmbedAssets bool
+	// Wordlist, if set, contains candidate passwords to try against VNC authentication
+	Wordlist io.Reader
+	// DHPrivateKeys contains Diffie-Hellman private values of either party,
+	// used to decrypt credentials in security types that use a key exchange
+	DHPrivateKeys []*big.Int
+	// TLSKeyLog and TLSPrivateKey are used to decrypt sessions wrapped in TLS
+	TLSKeyLog     KeyLog
+	TLSPrivateKey *rsa.PrivateKey
+	// MidStream, if set, indicates that the capture starts after the
+	// handshake
+	MidStream *MidStreamOptions
+
 	initialised  bool
 	htmlOut      io.WriteCloser
 	jsOut        *bytes.Buffer
@@ -21,8 +37,17 @@ type RFB struct {
 	timeOffset   float64
 	width        int
 	height       int
+	version      int
+	auth         AuthInfo
 	pixelFormat  PixelFormat
 	name         string
+	framebuffer  *image.RGBA
+	zlibStream   inflateStream
+	tightStreams [4]inflateStream
+	zrleStream   inflateStream
+	trlePalette  []color.RGBA
+	qualityLevel int
+	tight        *tightCapabilities
 }
 
 // New instatiates a new RFB struct
@@ -34,6 +59,7 @@ func New(out io.WriteCloser) (*RFB, error) {
 		jsOut:        &jsout,
 		clientBuffer: newBuffer(),
 		serverBuffer: newBuffer(),
+		qualityLevel: -1,
 	}
 
 	return rfb, nil
@@ -70,16 +96,16 @@ func (rfb *RFB) initialise() error {
 
 // ClientBytes adds a frame of bytes to the Client-side buffer
 func (rfb *RFB) ClientBytes(t time.Duration, offset int, buf []byte) error {
-	if !rfb.initialised {
-		rfb.initialise()
+	if err := rfb.initialise(); err != nil {
+		return err
 	}
 	return rfb.clientBuffer.Add(t, offset, buf)
 }
 
 // ServerBytes adds a frame of bytes to the Server-side buffer
 func (rfb *RFB) ServerBytes(t time.Duration, offset int, buf []byte) error {
-	if !rfb.initialised {
-		rfb.initialise()
+	if err := rfb.initialise(); err != nil {
+		return err
 	}
 	return rfb.serverBuffer.Add(t, offset, buf)
 }
@@ -108,10 +134,16 @@ func (rfb *RFB) Close() error {
 		rfb.htmlOut.Close()
 	}()
 
-	if err := rfb.consumeHandshake(); err != nil {
+	if rfb.MidStream != nil {
+		err = rfb.resync()
+	} else {
+		err = rfb.consumeHandshake()
+	}
+	if err != nil {
 		fmt.Fprintf(rfb.htmlOut, "<h2>error: %s</h2>\n", err)
 		return err
 	}
+	rfb.writeSessionInfo()
 
 	fmt.Fprintf(rfb.htmlOut, `<h3>All events</h3>`)
 	for rfb.clientBuffer.Remaining() > 0 && rfb.serverBuffer.Remaining() > 0 {
@@ -168,62 +200,6 @@ func (rfb *RFB) Close() error {
 	return nil
 }
 
-func (rfb *RFB) consumeHandshake() error {
-	// Server version
-	_ = rfb.nextS(12)
-
-	// Client version
-	_ = rfb.nextC(12)
-
-	// Server security types
-	nSecurity := rInt(rfb.nextS(1))
-	_ = rfb.nextS(1 * nSecurity)
-
-	// Client security choice
-	sec := rInt(rfb.nextC(1))
-
-	if sec == 2 {
-		// VNC authentication
-		_ = rfb.nextS(16)
-		_ = rfb.nextC(16)
-	} else {
-		return fmt.Errorf("authentication type %d not implemented", sec)
-	}
-
-	// Server init
-	securityResult := rInt(rfb.nextS(4))
-	if securityResult != 0 {
-		return fmt.Errorf("handshake failed: authentication failed: error %d", securityResult)
-	}
-
-	// Client init
-	cInit := rfb.nextC(1)
-	if len(cInit) != 1 {
-		return fmt.Errorf("handshake failed: client rejected")
-	}
-
-	// The 'start time' of the replay will be the time at which the final packet in the handshake is sent
-	rfb.timeOffset = floatTime(rfb.serverBuffer.CurrentTime())
-
-	// Server init
-	sInit := rfb.nextS(24)
-	if len(sInit) != 24 {
-		return fmt.Errorf("handshake failed: server rejected")
-	}
-	rfb.width = rInt(sInit[0:2])
-	rfb.height = rInt(sInit[2:4])
-	rfb.pixelFormat = ParsePixelFormat(sInit[4:20])
-	fmt.Fprintf(rfb.htmlOut, "<div>Remote display %dx%d, %s</div>\n", rfb.width, rfb.height, rfb.pixelFormat)
-	fmt.Fprintf(rfb.jsOut, "\n\nlet rfb = new RFB( %d, %d );\n\n", rfb.width, rfb.height)
-	nlen := rInt(sInit[20:24])
-	if nlen > 0 {
-		rfb.name = string(rfb.nextS(nlen))
-		fmt.Fprintf(rfb.htmlOut, "<div>Server name: %s</div>\n", rfb.name)
-	}
-
-	return nil
-}
-
 func (rfb *RFB) nextS(l int) []byte {
 	return rfb.serverBuffer.Consume(l)
 }
@@ -245,6 +221,24 @@ func (rfb *RFB) pushEvent(eventType string, tEvent time.Duration, eventData inte
 	fmt.Fprintf(rfb.jsOut, "rfb.PushEvent(%s);\n", s[1:len(s)-2])
 }
 
+// sessionInfo adds a line to the session information the player shows above
+// the event log
+func (rfb *RFB) sessionInfo(label, value string) {
+	b, _ := json.Marshal([]string{label, value})
+	fmt.Fprintf(rfb.jsOut, "rfb.SetSessionInfo(%s);\n", b[1:len(b)-1])
+}
+
+// writeSessionInfo adds the credentials recovered from the handshake to the
+// session information
+func (rfb *RFB) writeSessionInfo() {
+	if rfb.auth.Username != "" {
+		rfb.sessionInfo("Username", rfb.auth.Username)
+	}
+	if rfb.auth.PasswordFound {
+		rfb.sessionInfo("Password", rfb.auth.Password)
+	}
+}
+
 func rInt(b []byte) int {
 	var rv int = 0
 	for _, c := range b {
@@ -0,0 +1,57 @@
+package rfb
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+var errTruncated = errors.New("rectangle truncated")
+
+// decodeRRE decodes a rectangle in RRE or CoRRE encoding into rv. In the
+// compact (CoRRE) variant, the subrectangle geometry is sent as single bytes
+// rather than 16-bit integers.
+func (ppf PixelFormat) decodeRRE(buf []byte, rv *image.RGBA, compact bool) (int, error) {
+	bpp := ppf.BytesPerPixel()
+	if len(buf) < 4+bpp {
+		return len(buf), errTruncated
+	}
+
+	nSubrects := rInt(buf[0:4])
+	offset := 4
+	n, bg := ppf.ReadPixel(buf[offset:])
+	offset += n
+	fillRect(rv, rv.Bounds(), bg)
+
+	coordLen := 2
+	if compact {
+		coordLen = 1
+	}
+	subrectLen := bpp + 4*coordLen
+
+	origin := rv.Bounds().Min
+	for i := 0; i < nSubrects; i++ {
+		if offset+subrectLen > len(buf) {
+			return len(buf), errTruncated
+		}
+		n, c := ppf.ReadPixel(buf[offset:])
+		offset += n
+
+		sx := rInt(buf[offset+0*coordLen : offset+1*coordLen])
+		sy := rInt(buf[offset+1*coordLen : offset+2*coordLen])
+		sw := rInt(buf[offset+2*coordLen : offset+3*coordLen])
+		sh := rInt(buf[offset+3*coordLen : offset+4*coordLen])
+		offset += 4 * coordLen
+
+		r := image.Rect(sx, sy, sx+sw, sy+sh).Add(origin)
+		fillRect(rv, r, c)
+	}
+
+	return offset, nil
+}
+
+// fillRect paints the rectangle r in img a solid colour
+func fillRect(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	draw.Draw(img, r.Intersect(img.Bounds()), &image.Uniform{c}, image.Point{}, draw.Src)
+}
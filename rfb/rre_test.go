@@ -0,0 +1,108 @@
+package rfb
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// testColours maps the characters used in test pictures to colours
+var testColours = map[byte]color.RGBA{
+	'k': {0x00, 0x00, 0x00, 0xff},
+	'r': {0xff, 0x00, 0x00, 0xff},
+	'g': {0x00, 0xff, 0x00, 0xff},
+	'b': {0x00, 0x00, 0xff, 0xff},
+	'w': {0xff, 0xff, 0xff, 0xff},
+}
+
+// px encodes the colour with the given character in the rgb888 pixel format
+func px(c byte) []byte {
+	rgba := testColours[c]
+	return []byte{rgba.B, rgba.G, rgba.R, 0}
+}
+
+// checkPicture compares img to a picture, given as one string per row with a
+// character from testColours for each pixel
+func checkPicture(t *testing.T, img *image.RGBA, picture []string) {
+	t.Helper()
+	b := img.Bounds()
+	if len(picture) != b.Dy() || len(picture[0]) != b.Dx() {
+		t.Fatalf("picture is %dx%d; want %dx%d", len(picture[0]), len(picture), b.Dx(), b.Dy())
+	}
+	for j, row := range picture {
+		for i := range row {
+			x, y := b.Min.X+i, b.Min.Y+j
+			if got, want := img.RGBAAt(x, y), testColours[row[i]]; got != want {
+				t.Errorf("pixel (%d, %d) is %v; want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestRRE(t *testing.T) {
+	tests := []struct {
+		name    string
+		compact bool
+		buf     []byte
+		picture []string
+		wantErr error
+	}{
+		{
+			"background only", false,
+			concat([]byte{0, 0, 0, 0}, px('r')),
+			[]string{"rrrr", "rrrr", "rrrr"},
+			nil,
+		},
+		{
+			"subrectangles", false,
+			concat([]byte{0, 0, 0, 2}, px('r'),
+				px('g'), []byte{0, 0, 0, 0, 0, 2, 0, 2},
+				px('b'), []byte{0, 2, 0, 1, 0, 2, 0, 2}),
+			[]string{"ggrr", "ggbb", "rrbb"},
+			nil,
+		},
+		{
+			"clipped", false,
+			concat([]byte{0, 0, 0, 1}, px('w'), px('k'), []byte{0, 1, 0, 1, 0, 9, 0, 9}),
+			[]string{"wwww", "wkkk", "wkkk"},
+			nil,
+		},
+		{
+			"CoRRE", true,
+			concat([]byte{0, 0, 0, 2}, px('r'),
+				px('g'), []byte{0, 0, 2, 2},
+				px('b'), []byte{2, 1, 2, 2}),
+			[]string{"ggrr", "ggbb", "rrbb"},
+			nil,
+		},
+		{
+			"truncated", false,
+			concat([]byte{0, 0, 0, 2}, px('r'), px('g'), []byte{0, 0, 0, 0, 0, 2, 0, 2}),
+			nil,
+			errTruncated,
+		},
+		{
+			"no background", false,
+			[]byte{0, 0, 0, 0},
+			nil,
+			errTruncated,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// Subrectangles are relative to the rectangle
+			img := image.NewRGBA(image.Rect(10, 20, 14, 23))
+			n, err := StandardPixelFormats["rgb888"].decodeRRE(tc.buf, img, tc.compact)
+			if err != tc.wantErr {
+				t.Fatalf("got error %v; want %v", err, tc.wantErr)
+			}
+			if n != len(tc.buf) {
+				t.Errorf("consumed %d bytes; want %d", n, len(tc.buf))
+			}
+			if err == nil {
+				checkPicture(t, img, tc.picture)
+			}
+		})
+	}
+}
@@ -3,10 +3,12 @@ package rfb
 import (
 	"encoding/base64"
 	"fmt"
+	"html"
 	"image"
 	"image/draw"
 	"image/png"
 	"log"
+	"time"
 )
 
 type framebuffer struct {
@@ -19,6 +21,18 @@ type pointerSkin struct {
 	X, Y    int
 }
 
+type desktopSize struct {
+	Width, Height int
+}
+
+type pointerPosition struct {
+	X, Y int
+}
+
+type desktopName struct {
+	Name string
+}
+
 type serverCutText struct {
 	Text string
 }
@@ -65,6 +79,9 @@ func (rfb *RFB) consumeServerEvent() error {
 }
 
 func (rfb *RFB) decodeFrameBufferUpdate() int {
+	if rfb.framebuffer == nil {
+		rfb.framebuffer = image.NewRGBA(image.Rect(0, 0, rfb.width, rfb.height))
+	}
 	targetImage := image.NewRGBA(image.Rect(0, 0, rfb.width, rfb.height))
 
 	tEvent := rfb.serverBuffer.CurrentTime()
@@ -75,29 +92,76 @@ func (rfb *RFB) decodeFrameBufferUpdate() int {
 
 	offset := 4
 	for i := 0; i < nRects; i++ {
-		n, img, enctype := rfb.pixelFormat.nextRect(buf[offset:])
+		if offset >= len(buf) {
+			log.Printf("Warning: framebuffer update truncated after %d of %d rectangles", i, nRects)
+			break
+		}
+		n, img, enctype := rfb.nextRect(buf[offset:])
 		offset += n
 
-		if enctype == -239 {
+		if enctype == -224 {
+			// LastRect pseudo-encoding: servers that don't know the number of
+			// rectangles in advance send 0xFFFF, and end the update with this.
+			break
+		} else if enctype == -239 || enctype == -240 || enctype == -314 {
 			rfb.handleCursorUpdate(img)
+		} else if enctype == -232 {
+			// PointerPos pseudo-encoding: the server moved the cursor
+			pos := img.Bounds().Min
+			evt := pointerPosition{X: pos.X, Y: pos.Y}
+			fmt.Fprintf(rfb.htmlOut, "<div>Server moved pointer to %d,%d</div>\n", evt.X, evt.Y)
+			rfb.pushEvent("pointer-position", tEvent, evt)
+		} else if enctype == -223 || enctype == -308 {
+			if targetImage.Bounds() != rfb.framebuffer.Bounds() {
+				// Anything drawn so far was drawn at the old size
+				if rectsAdded > 0 {
+					rfb.pushFramebuffer(tEvent, fmt.Sprintf("framebuffer_%08x", rfb.serverBuffer.CurrentOffset()+offset), targetImage)
+					rectsAdded = 0
+				}
+
+				fmt.Fprintf(rfb.htmlOut, "<div>Remote display resized to %dx%d</div>\n", rfb.width, rfb.height)
+				rfb.pushEvent("desktop-size", tEvent, desktopSize{Width: rfb.width, Height: rfb.height})
+				targetImage = image.NewRGBA(rfb.framebuffer.Bounds())
+			}
 		} else if img != nil {
 			b := img.Bounds()
 			draw.Draw(targetImage, b, img, b.Min, draw.Over)
+			// Keep track of the complete framebuffer, so subsequent rectangles can refer to it
+			draw.Draw(rfb.framebuffer, b, img, b.Min, draw.Src)
 			rectsAdded++
 		}
 	}
 
 	if rectsAdded > 0 {
-		fmt.Fprintf(rfb.htmlOut, "<div>framebuffer update: <img style=\"max-width: 1.5em;\" id=\"framebuffer_%08x\" src=\"data:image/png;base64,", rfb.serverBuffer.CurrentOffset())
-		png.Encode(base64.NewEncoder(base64.StdEncoding, rfb.htmlOut), targetImage)
-		fmt.Fprintf(rfb.htmlOut, "\" /></div>\n")
-
-		rfb.pushEvent("framebuffer", tEvent, framebuffer{Id: fmt.Sprintf("framebuffer_%08x", rfb.serverBuffer.CurrentOffset())})
+		rfb.pushFramebuffer(tEvent, fmt.Sprintf("framebuffer_%08x", rfb.serverBuffer.CurrentOffset()), targetImage)
 	}
 
 	return offset
 }
 
+func (rfb *RFB) pushFramebuffer(tEvent time.Duration, id string, img image.Image) {
+	fmt.Fprintf(rfb.htmlOut, "<div>framebuffer update: <img style=\"max-width: 1.5em;\" id=\"%s\" src=\"data:image/png;base64,", id)
+	png.Encode(base64.NewEncoder(base64.StdEncoding, rfb.htmlOut), img)
+	fmt.Fprintf(rfb.htmlOut, "\" /></div>\n")
+
+	rfb.pushEvent("framebuffer", tEvent, framebuffer{Id: id})
+}
+
+// resize changes the size of the remote display, keeping as much of the
+// current framebuffer contents as will fit
+func (rfb *RFB) resize(width, height int) {
+	if width == 0 || height == 0 {
+		return
+	}
+	rfb.width, rfb.height = width, height
+
+	fb := image.NewRGBA(image.Rect(0, 0, width, height))
+	if rfb.framebuffer != nil {
+		draw.Draw(fb, fb.Bounds(), rfb.framebuffer, image.Point{}, draw.Src)
+	}
+	rfb.framebuffer = fb
+}
+
 func (rfb *RFB) handleCursorUpdate(img image.Image) {
 	tEvent := rfb.serverBuffer.CurrentTime()
 	if img.Bounds().Dx() > 0 && img.Bounds().Dy() > 0 {
@@ -117,7 +181,20 @@ func (rfb *RFB) handleCursorUpdate(img image.Image) {
 	}
 }
 
-func (ppf PixelFormat) nextRect(buf []byte) (bytesRead int, img image.Image, enctype int32) {
+func (rfb *RFB) handleDesktopName(name string) {
+	tEvent := rfb.serverBuffer.CurrentTime()
+	rfb.name = name
+	fmt.Fprintf(rfb.htmlOut, "<div>Desktop name changed to: %s</div>\n", html.EscapeString(name))
+	rfb.pushEvent("desktop-name", tEvent, desktopName{Name: name})
+}
+
+func (rfb *RFB) nextRect(buf []byte) (bytesRead int, img image.Image, enctype int32) {
+	if len(buf) < 12 {
+		log.Printf("Warning: rectangle header truncated")
+		return len(buf), nil, 0
+	}
+
+	ppf := rfb.pixelFormat
 	x := rInt(buf[0:2])
 	y := rInt(buf[2:4])
 	w := rInt(buf[4:6])
@@ -166,10 +243,113 @@ func (ppf PixelFormat) nextRect(buf []byte) (bytesRead int, img image.Image, enc
 		}
 
 		return offset + bitmaskOffset, rv, enctype
-	} else {
-		log.Printf("Unknown encoding type - ignoring whole buffer")
-		return len(buf), nil, enctype
+	} else if enctype == 1 {
+		// CopyRect encoding: the rectangle is a copy of another region in the
+		// framebuffer as it currently stands.
+		if len(buf) < 16 {
+			return len(buf), nil, enctype
+		}
+		srcX := rInt(buf[12:14])
+		srcY := rInt(buf[14:16])
+
+		draw.Draw(rv, rv.Bounds(), rfb.framebuffer, image.Pt(srcX, srcY), draw.Src)
+		return 16, rv, enctype
+	} else if enctype == 2 || enctype == 4 {
+		// RRE and CoRRE encodings
+		n, err := ppf.decodeRRE(buf[12:], rv, enctype == 4)
+		if err != nil {
+			log.Printf("Warning: %s", err)
+		}
+		return 12 + n, rv, enctype
+	} else if enctype == 5 {
+		// Hextile encoding
+		n, err := ppf.decodeHextile(buf[12:], rv)
+		if err != nil {
+			log.Printf("Warning: %s", err)
+		}
+		return 12 + n, rv, enctype
+	} else if enctype == 6 {
+		// Zlib encoding
+		n, err := rfb.decodeZlib(buf[12:], rv)
+		if err != nil {
+			log.Printf("Warning: %s", err)
+		}
+		return 12 + n, rv, enctype
+	} else if enctype == 7 {
+		// Tight encoding
+		n, err := rfb.decodeTight(buf[12:], rv)
+		if err != nil {
+			log.Printf("Warning: %s", err)
+		}
+		return 12 + n, rv, enctype
+	} else if enctype == 15 {
+		// TRLE encoding
+		n, err := rfb.decodeTRLE(buf[12:], rv)
+		if err != nil {
+			log.Printf("Warning: %s", err)
+		}
+		return 12 + n, rv, enctype
+	} else if enctype == 16 || enctype == 17 {
+		// ZRLE and ZYWRLE encodings
+		level := 0
+		if enctype == 17 {
+			level = zywrleLevel(rfb.qualityLevel)
+		}
+		n, err := rfb.decodeZRLE(buf[12:], rv, level)
+		if err != nil {
+			log.Printf("Warning: %s", err)
+		}
+		return 12 + n, rv, enctype
+	} else if enctype == -240 {
+		// XCursor pseudo-encoding
+		n, err := decodeXCursor(buf[12:], rv)
+		if err != nil {
+			log.Printf("Warning: %s", err)
+		}
+		return 12 + n, rv, enctype
+	} else if enctype == -314 {
+		// Cursor With Alpha pseudo-encoding
+		n, err := decodeAlphaCursor(buf[12:], rv)
+		if err != nil {
+			log.Printf("Warning: %s", err)
+		}
+		return 12 + n, rv, enctype
+	} else if enctype == -307 {
+		// DesktopName pseudo-encoding
+		if len(buf) < 16 {
+			return len(buf), nil, enctype
+		}
+		l := rInt(buf[12:16])
+		if 16+l > len(buf) {
+			return len(buf), nil, enctype
+		}
+		rfb.handleDesktopName(string(buf[16 : 16+l]))
+		return 16 + l, nil, enctype
+	} else if enctype == -224 {
+		// LastRect pseudo-encoding
+		return 12, nil, enctype
+	} else if enctype == -232 {
+		// PointerPos pseudo-encoding. The new cursor position is the
+		// rectangle's position; it carries no data.
+		return 12, rv, enctype
+	} else if enctype == -223 {
+		// DesktopSize pseudo-encoding
+		rfb.resize(w, h)
+		return 12, nil, enctype
+	} else if enctype == -308 {
+		// ExtendedDesktopSize pseudo-encoding. The x and y fields contain the
+		// reason for and status of the change; a nonzero status means the
+		// requested change was rejected.
+		if len(buf) < 16 {
+			return len(buf), nil, enctype
+		}
+		nScreens := rInt(buf[12:13])
+		if y == 0 {
+			rfb.resize(w, h)
+		}
+		return 16 + 16*nScreens, nil, enctype
 	}
 
-	return 12, nil, 0
+	log.Printf("Unknown encoding type %d - ignoring whole buffer", enctype)
+	return len(buf), nil, enctype
 }
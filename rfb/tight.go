@@ -0,0 +1,285 @@
+package rfb
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+)
+
+// Tight compression types, found in the upper nibble of the compression
+// control byte
+const (
+	tightFill = 0x8
+	tightJPEG = 0x9
+)
+
+// Tight filter types
+const (
+	tightFilterCopy     = 0
+	tightFilterPalette  = 1
+	tightFilterGradient = 2
+)
+
+// Data shorter than this is sent without zlib compression
+const tightMinToCompress = 12
+
+// decodeTight decodes a rectangle in Tight encoding into rv
+func (rfb *RFB) decodeTight(buf []byte, rv *image.RGBA) (int, error) {
+	ppf := rfb.pixelFormat
+	if len(buf) < 1 {
+		return len(buf), errTruncated
+	}
+
+	control := buf[0]
+	offset := 1
+
+	// The lower four bits instruct the client to reset the zlib streams
+	for i := range rfb.tightStreams {
+		if control&(1<<uint(i)) != 0 {
+			rfb.tightStreams[i].Reset()
+		}
+	}
+
+	compression := control >> 4
+	bounds := rv.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	if compression == tightFill {
+		if offset+ppf.tightPixelSize() > len(buf) {
+			return len(buf), errTruncated
+		}
+		n, c := ppf.readTightPixel(buf[offset:])
+		offset += n
+		fillRect(rv, bounds, c)
+		return offset, nil
+	} else if compression == tightJPEG {
+		n, l := readCompactLength(buf[offset:])
+		offset += n
+		if n == 0 || offset+l > len(buf) {
+			return len(buf), errTruncated
+		}
+		img, err := jpeg.Decode(bytes.NewReader(buf[offset : offset+l]))
+		offset += l
+		if err != nil {
+			return offset, fmt.Errorf("error decoding JPEG rectangle: %s", err)
+		}
+		draw.Draw(rv, bounds, img, img.Bounds().Min, draw.Src)
+		return offset, nil
+	} else if compression > tightJPEG {
+		return len(buf), fmt.Errorf("unknown Tight compression type 0x%x", compression)
+	}
+
+	// Basic compression
+	streamID := int(compression & 0x3)
+	filter := tightFilterCopy
+	if compression&0x4 != 0 {
+		if offset >= len(buf) {
+			return len(buf), errTruncated
+		}
+		filter = int(buf[offset])
+		offset++
+	}
+
+	tpixelSize := ppf.tightPixelSize()
+	var palette []color.RGBA
+	dataSize := w * h * tpixelSize
+
+	if filter == tightFilterPalette {
+		if offset >= len(buf) {
+			return len(buf), errTruncated
+		}
+		nColours := int(buf[offset]) + 1
+		offset++
+		if offset+nColours*tpixelSize > len(buf) {
+			return len(buf), errTruncated
+		}
+		palette = make([]color.RGBA, nColours)
+		for i := range palette {
+			n, c := ppf.readTightPixel(buf[offset:])
+			offset += n
+			palette[i] = c
+		}
+
+		if nColours == 2 {
+			dataSize = ((w + 7) / 8) * h
+		} else {
+			dataSize = w * h
+		}
+	} else if filter != tightFilterCopy && filter != tightFilterGradient {
+		return len(buf), fmt.Errorf("unknown Tight filter type %d", filter)
+	}
+
+	var data []byte
+	if dataSize < tightMinToCompress {
+		if offset+dataSize > len(buf) {
+			return len(buf), errTruncated
+		}
+		data = buf[offset : offset+dataSize]
+		offset += dataSize
+	} else {
+		n, l := readCompactLength(buf[offset:])
+		offset += n
+		if n == 0 || offset+l > len(buf) {
+			return len(buf), errTruncated
+		}
+		var err error
+		data, err = rfb.tightStreams[streamID].Inflate(buf[offset:offset+l], dataSize)
+		offset += l
+		if err != nil {
+			return offset, err
+		}
+	}
+
+	if filter == tightFilterPalette {
+		decodeTightPalette(data, palette, rv)
+	} else if filter == tightFilterGradient {
+		ppf.decodeTightGradient(data, rv)
+	} else {
+		i := 0
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				n, c := ppf.readTightPixel(data[i:])
+				i += n
+				rv.SetRGBA(x, y, c)
+			}
+		}
+	}
+
+	return offset, nil
+}
+
+// decodeTightPalette draws palette-indexed pixel data into rv. Two-colour
+// palettes use one bit per pixel, with each row padded to a whole byte.
+func decodeTightPalette(data []byte, palette []color.RGBA, rv *image.RGBA) {
+	bounds := rv.Bounds()
+	w := bounds.Dx()
+	lineLength := (w + 7) / 8
+
+	for j := 0; j < bounds.Dy(); j++ {
+		for i := 0; i < w; i++ {
+			var idx int
+			if len(palette) == 2 {
+				idx = int(data[j*lineLength+i/8]>>(7-uint(i&0x7))) & 0x1
+			} else {
+				idx = int(data[j*w+i])
+			}
+			if idx < len(palette) {
+				rv.SetRGBA(bounds.Min.X+i, bounds.Min.Y+j, palette[idx])
+			}
+		}
+	}
+}
+
+// decodeTightGradient reverses the gradient filter. Each colour component is
+// sent as the difference from a prediction based on the pixels to the left,
+// above, and above left of it.
+func (ppf PixelFormat) decodeTightGradient(data []byte, rv *image.RGBA) {
+	bounds := rv.Bounds()
+	w := bounds.Dx()
+	max := ppf.tightComponentMax()
+
+	prevRow := make([][3]int, w)
+	thisRow := make([][3]int, w)
+
+	offset := 0
+	for j := 0; j < bounds.Dy(); j++ {
+		for i := 0; i < w; i++ {
+			n, diff := ppf.readTightComponents(data[offset:])
+			offset += n
+
+			for k := 0; k < 3; k++ {
+				var left, up, upleft int
+				up = prevRow[i][k]
+				if i > 0 {
+					left = thisRow[i-1][k]
+					upleft = prevRow[i-1][k]
+				}
+
+				predicted := left + up - upleft
+				if predicted < 0 {
+					predicted = 0
+				} else if predicted > max[k] {
+					predicted = max[k]
+				}
+
+				thisRow[i][k] = (predicted + diff[k]) & max[k]
+			}
+
+			c := thisRow[i]
+			rv.SetRGBA(bounds.Min.X+i, bounds.Min.Y+j, color.RGBA{
+				R: scaleComponent(uint(c[0]), uint(max[0])),
+				G: scaleComponent(uint(c[1]), uint(max[1])),
+				B: scaleComponent(uint(c[2]), uint(max[2])),
+				A: 0xff,
+			})
+		}
+
+		prevRow, thisRow = thisRow, prevRow
+	}
+}
+
+// isTight24 returns whether pixels are sent as three bytes in Tight encoding,
+// rather than in the full pixel format
+func (ppf PixelFormat) isTight24() bool {
+	return ppf.TrueColour && ppf.Bits == 32 && ppf.Depth == 24 && ppf.RedMax == 0xff && ppf.GreenMax == 0xff && ppf.BlueMax == 0xff
+}
+
+// tightPixelSize returns the length of a single pixel in Tight encoding
+func (ppf PixelFormat) tightPixelSize() int {
+	if ppf.isTight24() {
+		return 3
+	}
+	return ppf.BytesPerPixel()
+}
+
+// readTightPixel reads a single pixel in Tight encoding
+func (ppf PixelFormat) readTightPixel(buf []byte) (int, color.RGBA) {
+	if ppf.isTight24() {
+		return 3, color.RGBA{R: buf[0], G: buf[1], B: buf[2], A: 0xff}
+	}
+	return ppf.ReadPixel(buf)
+}
+
+// readTightComponents reads a single pixel in Tight encoding, and returns its
+// unscaled red, green and blue components
+func (ppf PixelFormat) readTightComponents(buf []byte) (int, [3]int) {
+	if ppf.isTight24() {
+		return 3, [3]int{int(buf[0]), int(buf[1]), int(buf[2])}
+	}
+	n, pixel := ppf.readPixelValue(buf)
+	return n, [3]int{
+		int((pixel >> ppf.RedShift) & ppf.RedMax),
+		int((pixel >> ppf.GreenShift) & ppf.GreenMax),
+		int((pixel >> ppf.BlueShift) & ppf.BlueMax),
+	}
+}
+
+// tightComponentMax returns the maximum value of each colour component
+func (ppf PixelFormat) tightComponentMax() [3]int {
+	return [3]int{int(ppf.RedMax), int(ppf.GreenMax), int(ppf.BlueMax)}
+}
+
+// readCompactLength reads a length value in Tight's compact representation,
+// in which each byte contributes 7 bits and the high bit signals that another
+// byte follows. It returns 0 bytes read if the buffer is too short.
+func readCompactLength(buf []byte) (int, int) {
+	rv := 0
+	for i := 0; i < 3; i++ {
+		if i >= len(buf) {
+			return 0, 0
+		}
+		b := int(buf[i])
+		if i == 2 {
+			rv |= b << 14
+			return 3, rv
+		}
+		rv |= (b & 0x7f) << (7 * uint(i))
+		if b&0x80 == 0 {
+			return i + 1, rv
+		}
+	}
+	return 3, rv
+}
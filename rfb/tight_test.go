@@ -0,0 +1,165 @@
+package rfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// tightCompressed compresses data as the start of a Tight zlib stream, and
+// prefixes it with its compact length
+func tightCompressed(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(data)
+	zw.Flush()
+
+	return append(compactLength(buf.Len()), buf.Bytes()...)
+}
+
+// compactLength encodes a length in Tight's compact representation
+func compactLength(l int) []byte {
+	var rv []byte
+	for l >= 0x80 {
+		rv = append(rv, byte(l)|0x80)
+		l >>= 7
+	}
+	return append(rv, byte(l))
+}
+
+// tpx encodes the colour with the given character as a Tight pixel in the
+// rgb888 pixel format
+func tpx(c byte) []byte {
+	rgba := testColours[c]
+	return []byte{rgba.R, rgba.G, rgba.B}
+}
+
+func TestTight(t *testing.T) {
+	white := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	fillRect(white, white.Bounds(), testColours['w'])
+	var jpegData bytes.Buffer
+	jpeg.Encode(&jpegData, white, &jpeg.Options{Quality: 100})
+
+	tests := []struct {
+		name    string
+		buf     []byte
+		picture []string
+		wantErr bool
+	}{
+		{
+			"fill",
+			concat([]byte{0x80}, tpx('g')),
+			[]string{"gggg", "gggg", "gggg"},
+			false,
+		},
+		{
+			"uncompressed copy",
+			concat([]byte{0x00}, tpx('r'), tpx('g'), tpx('b')),
+			[]string{"rgb"},
+			false,
+		},
+		{
+			"compressed copy",
+			concat([]byte{0x00}, tightCompressed(concat(
+				tpx('r'), tpx('g'), tpx('b'), tpx('w'),
+				tpx('k'), tpx('k'), tpx('k'), tpx('k'),
+				tpx('w'), tpx('b'), tpx('g'), tpx('r'),
+			))),
+			[]string{"rgbw", "kkkk", "wbgr"},
+			false,
+		},
+		{
+			"two-colour palette",
+			concat([]byte{0x40, tightFilterPalette, 1}, tpx('r'), tpx('b'), []byte{0xa0, 0x50, 0xf0}),
+			[]string{"brbr", "rbrb", "bbbb"},
+			false,
+		},
+		{
+			"palette on stream 1",
+			concat([]byte{0x50, tightFilterPalette, 2}, tpx('r'), tpx('g'), tpx('b'), tightCompressed([]byte{
+				0, 1, 2, 0,
+				1, 2, 0, 1,
+				2, 2, 2, 2,
+			})),
+			[]string{"rgbr", "gbrg", "bbbb"},
+			false,
+		},
+		{
+			"gradient",
+			concat([]byte{0x40, tightFilterGradient}, tightCompressed([]byte{
+				255, 0, 0, 1, 255, 0,
+				1, 0, 255, 255, 0, 0,
+			})),
+			[]string{"rg", "bw"},
+			false,
+		},
+		{
+			"JPEG",
+			concat([]byte{0x90}, compactLength(jpegData.Len()), jpegData.Bytes()),
+			[]string{"wwwwwwww", "wwwwwwww", "wwwwwwww", "wwwwwwww", "wwwwwwww", "wwwwwwww", "wwwwwwww", "wwwwwwww"},
+			false,
+		},
+		{
+			"truncated fill",
+			[]byte{0x80, 0xff},
+			[]string{"k"},
+			true,
+		},
+		{
+			"truncated palette",
+			concat([]byte{0x40, tightFilterPalette, 3}, tpx('r'), tpx('g')),
+			[]string{"k"},
+			true,
+		},
+		{
+			"unknown filter",
+			[]byte{0x40, 3, 0, 0, 0},
+			[]string{"k"},
+			true,
+		},
+		{
+			"unknown compression",
+			[]byte{0xa0},
+			[]string{"k"},
+			true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rfb := &RFB{pixelFormat: StandardPixelFormats["rgb888"]}
+			img := image.NewRGBA(image.Rect(0, 0, len(tc.picture[0]), len(tc.picture)))
+			n, err := rfb.decodeTight(tc.buf, img)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v; want error: %v", err, tc.wantErr)
+			}
+			if n != len(tc.buf) {
+				t.Errorf("consumed %d bytes; want %d", n, len(tc.buf))
+			}
+			if err == nil {
+				checkPicture(t, img, tc.picture)
+			}
+		})
+	}
+}
+
+func TestTightStreamReset(t *testing.T) {
+	rfb := &RFB{pixelFormat: StandardPixelFormats["rgb888"]}
+	rect := concat([]byte{0x40, tightFilterPalette, 2}, tpx('r'), tpx('g'), tpx('b'), tightCompressed(make([]byte, 12)))
+
+	// Without a reset, the second rectangle would continue the first
+	// stream, and its zlib header would be read as compressed data
+	for i, control := range []byte{0x40, 0x41} {
+		rect[0] = control
+		img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+		if _, err := rfb.decodeTight(rect, img); err != nil {
+			t.Fatalf("rectangle %d: %s", i, err)
+		}
+		if c := img.RGBAAt(3, 2); c != (color.RGBA{R: 0xff, A: 0xff}) {
+			t.Errorf("rectangle %d: pixel is %v; want red", i, c)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package rfb
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// A tightCapability describes a tunnel type, authentication scheme, message
+// type or encoding supported by a TightVNC peer
+type tightCapability struct {
+	Code      int32
+	Vendor    string
+	Signature string
+}
+
+func (c tightCapability) String() string {
+	return fmt.Sprintf("%s %s (%d)", c.Vendor, c.Signature, c.Code)
+}
+
+// tightCapabilities contains the capabilities advertised in a session that
+// uses the Tight security type
+type tightCapabilities struct {
+	Tunnels   []tightCapability
+	Auth      []tightCapability
+	Server    []tightCapability
+	Client    []tightCapability
+	Encodings []tightCapability
+}
+
+// Tight authentication schemes
+const (
+	tightAuthNone = 1
+	tightAuthVNC  = 2
+)
+
+// readTightCapabilities reads a list of n capabilities from the server
+func (rfb *RFB) readTightCapabilities(n int) ([]tightCapability, error) {
+	buf := rfb.nextS(16 * n)
+	if len(buf) != 16*n {
+		return nil, fmt.Errorf("handshake failed: capability list truncated")
+	}
+
+	rv := make([]tightCapability, n)
+	for i := range rv {
+		c := buf[16*i : 16*(i+1)]
+		rv[i] = tightCapability{
+			Code:      int32(rInt(c[0:4])),
+			Vendor:    string(c[4:8]),
+			Signature: string(c[8:16]),
+		}
+	}
+	return rv, nil
+}
+
+// writeTightCapabilities describes a list of capabilities in the HTML output
+func (rfb *RFB) writeTightCapabilities(description string, caps []tightCapability) {
+	names := make([]string, len(caps))
+	for i, c := range caps {
+		names[i] = html.EscapeString(c.String())
+	}
+	fmt.Fprintf(rfb.htmlOut, "<div>%s: %s</div>\n", description, strings.Join(names, ", "))
+}
+
+// consumeTightSecurity reads the tunnel and authentication negotiation of
+// the Tight security type
+func (rfb *RFB) consumeTightSecurity() error {
+	rfb.tight = &tightCapabilities{}
+
+	var err error
+	nTunnels := rInt(rfb.nextS(4))
+	if nTunnels > 0 {
+		rfb.tight.Tunnels, err = rfb.readTightCapabilities(nTunnels)
+		if err != nil {
+			return err
+		}
+		rfb.writeTightCapabilities("Tight tunnel types", rfb.tight.Tunnels)
+
+		if tunnel := rInt(rfb.nextC(4)); tunnel != 0 {
+			fmt.Fprintf(rfb.htmlOut, "<div class=\"-todo\">Tight tunnel type %d not implemented - skipping to ServerInit</div>\n", tunnel)
+			return errUnknownSecurity
+		}
+	}
+
+	nAuth := rInt(rfb.nextS(4))
+	if nAuth == 0 {
+		// No authentication
+		if rfb.version >= 8 {
+			return rfb.consumeSecurityResult()
+		}
+		return nil
+	}
+
+	rfb.tight.Auth, err = rfb.readTightCapabilities(nAuth)
+	if err != nil {
+		return err
+	}
+	rfb.writeTightCapabilities("Tight authentication schemes", rfb.tight.Auth)
+
+	auth := rInt(rfb.nextC(4))
+	if auth == tightAuthNone {
+		if rfb.version >= 8 {
+			return rfb.consumeSecurityResult()
+		}
+		return nil
+	} else if auth == tightAuthVNC {
+		rfb.consumeVNCAuth()
+		return rfb.consumeSecurityResult()
+	}
+
+	fmt.Fprintf(rfb.htmlOut, "<div class=\"-todo\">Tight authentication scheme %d not implemented - skipping to ServerInit</div>\n", auth)
+	return errUnknownSecurity
+}
+
+// consumeTightInteraction reads the capability tables the server sends
+// after its ServerInit message, if the session uses the Tight security type
+func (rfb *RFB) consumeTightInteraction() error {
+	if rfb.tight == nil {
+		return nil
+	}
+
+	counts := rfb.nextS(8)
+	if len(counts) != 8 {
+		return fmt.Errorf("handshake failed: Tight capability tables truncated")
+	}
+
+	var err error
+	rfb.tight.Server, err = rfb.readTightCapabilities(rInt(counts[0:2]))
+	if err != nil {
+		return err
+	}
+	rfb.tight.Client, err = rfb.readTightCapabilities(rInt(counts[2:4]))
+	if err != nil {
+		return err
+	}
+	rfb.tight.Encodings, err = rfb.readTightCapabilities(rInt(counts[4:6]))
+	if err != nil {
+		return err
+	}
+
+	rfb.writeTightCapabilities("Tight server message types", rfb.tight.Server)
+	rfb.writeTightCapabilities("Tight client message types", rfb.tight.Client)
+	rfb.writeTightCapabilities("Tight encodings", rfb.tight.Encodings)
+	return nil
+}
@@ -2,7 +2,7 @@ package rfb
 
 import (
 	"fmt"
-	"log"
+	"sort"
 	"time"
 )
 
@@ -11,12 +11,22 @@ type timeindex struct {
 	i int
 }
 
+// A span is a range of offsets in a buffer
+type span struct {
+	start, end int
+}
+
+// maxGap is the largest number of missing bytes a segment may skip over
+const maxGap = 64 << 20
+
 type timedBuffer struct {
-	buf         []byte
-	timingDirty bool
-	timing      []timeindex
-	tmax        time.Duration
-	index       int
+	buf      []byte
+	received []span
+	// timing marks the time at which each received range of bytes was
+	// first seen, sorted by offset
+	timing []timeindex
+	tmax   time.Duration
+	index  int
 }
 
 func newBuffer() *timedBuffer {
@@ -26,22 +36,30 @@ func newBuffer() *timedBuffer {
 	}
 }
 
-// Add adds a byte slice to the buffer at offset offset
+// Add adds a byte slice to the buffer at offset offset. Segments may arrive
+// out of order or overlap. Bytes that were already received, for example in
+// a retransmission, are ignored, so each byte keeps the time it was first
+// seen.
 func (tb *timedBuffer) Add(t time.Duration, offset int, buf []byte) error {
-	if offset == len(tb.buf) {
-		// Simple case: in-order, contiguous packet delivery
-		tb.timing = append(tb.timing, timeindex{t, len(tb.buf)})
-		tb.buf = append(tb.buf, buf...)
-	} else if offset > len(tb.buf) {
-		// We've skipped some bytes. Fill with skip bytes.
-		for i := len(tb.buf); i < offset; i++ {
+	if offset < 0 {
+		return fmt.Errorf("sequence mismatch: segment starts before the start of the stream (offset %d)", offset)
+	} else if offset-len(tb.buf) > maxGap {
+		return fmt.Errorf("sequence mismatch: segment at offset 0x%x skips 0x%x bytes", offset, offset-len(tb.buf))
+	}
+
+	end := offset + len(buf)
+	if end > len(tb.buf) {
+		// Fill any bytes we haven't seen yet with skip bytes, until the
+		// segments containing them arrive.
+		for i := len(tb.buf); i < end; i++ {
 			tb.buf = append(tb.buf, 111)
 		}
-		tb.timing = append(tb.timing, timeindex{t, len(tb.buf)})
-		tb.buf = append(tb.buf, buf...)
-	} else {
-		tb.timingDirty = true
-		return fmt.Errorf("sequence mismatch: already have 0x%02x bytes; about to receive offset 0x%02x (dealing with this has not been implemented)", len(tb.buf), offset)
+	}
+
+	for _, gap := range tb.missing(offset, end) {
+		copy(tb.buf[gap.start:gap.end], buf[gap.start-offset:gap.end-offset])
+		tb.addTiming(timeindex{t, gap.start})
+		tb.markReceived(gap)
 	}
 
 	if t > tb.tmax {
@@ -51,6 +69,77 @@ func (tb *timedBuffer) Add(t time.Duration, offset int, buf []byte) error {
 	return nil
 }
 
+// addTiming inserts an entry in the timing index, keeping it sorted. Since
+// every newly received range gets its own entry, the bytes following it
+// still belong to the entry they had before.
+func (tb *timedBuffer) addTiming(ti timeindex) {
+	n := len(tb.timing)
+	if n == 0 || tb.timing[n-1].i < ti.i {
+		// Simple case: in-order delivery
+		tb.timing = append(tb.timing, ti)
+		return
+	}
+
+	j := sort.Search(n, func(j int) bool {
+		return tb.timing[j].i >= ti.i
+	})
+	tb.timing = append(tb.timing, timeindex{})
+	copy(tb.timing[j+1:], tb.timing[j:])
+	tb.timing[j] = ti
+}
+
+// nextBoundary returns the offset of the first segment that starts after
+// offset i, or the end of the buffer if there is none
+func (tb *timedBuffer) nextBoundary(i int) int {
+	j := sort.Search(len(tb.timing), func(j int) bool {
+		return tb.timing[j].i > i
+	})
+	if j < len(tb.timing) {
+		return tb.timing[j].i
+	}
+	return len(tb.buf)
+}
+
+// missing returns the parts of the range [start,end) that haven't been
+// received yet
+func (tb *timedBuffer) missing(start, end int) []span {
+	var rv []span
+	for _, r := range tb.received {
+		if r.end <= start {
+			continue
+		}
+		if r.start >= end {
+			break
+		}
+		if r.start > start {
+			rv = append(rv, span{start, r.start})
+		}
+		start = r.end
+	}
+	if start < end {
+		rv = append(rv, span{start, end})
+	}
+	return rv
+}
+
+// markReceived adds a range to the list of received bytes, merging it with
+// adjacent ranges
+func (tb *timedBuffer) markReceived(s span) {
+	i := sort.Search(len(tb.received), func(i int) bool {
+		return tb.received[i].end >= s.start
+	})
+	j := i
+	for ; j < len(tb.received) && tb.received[j].start <= s.end; j++ {
+		if tb.received[j].start < s.start {
+			s.start = tb.received[j].start
+		}
+		if tb.received[j].end > s.end {
+			s.end = tb.received[j].end
+		}
+	}
+	tb.received = append(tb.received[:i], append([]span{s}, tb.received[j:]...)...)
+}
+
 // Consume returns a slice of l bytes from the buffer, and advances its
 // internal pointer
 func (tb *timedBuffer) Consume(l int) []byte {
@@ -66,23 +155,45 @@ func (tb *timedBuffer) Consume(l int) []byte {
 // Dump discards bytes from the buffer until the next logical start point, or
 // until the end, whichever comes first.
 func (tb *timedBuffer) Dump() int {
-	rv := tb.Remaining()
+	rv := tb.nextBoundary(tb.index) - tb.index
+	tb.index += rv
+	return rv
+}
 
-	// Try to find the next packet boundary
-	if !tb.timingDirty {
-		for _, tc := range tb.timing {
-			if tc.i <= tb.index {
-				continue
-			}
-			rv = tc.i - tb.index
-			break
+// SkipUntil advances the internal pointer to the first packet that arrived
+// at or after time t, or to the end of the buffer if there is none.
+func (tb *timedBuffer) SkipUntil(t time.Duration) int {
+	rv := tb.Remaining()
+	for _, tc := range tb.timing {
+		if tc.i < tb.index || tc.t < t {
+			continue
 		}
+		rv = tc.i - tb.index
+		break
 	}
 
 	tb.index += rv
 	return rv
 }
 
+// Find returns the position, relative to the internal pointer, of the first
+// offset at which match returns true for the remainder of the buffer. Segment
+// boundaries are tried before any other offset. It returns -1 if there is no
+// match.
+func (tb *timedBuffer) Find(match func(buf []byte) bool) int {
+	for _, tc := range tb.timing {
+		if tc.i >= tb.index && match(tb.buf[tc.i:]) {
+			return tc.i - tb.index
+		}
+	}
+	for i := tb.index; i < len(tb.buf); i++ {
+		if match(tb.buf[i:]) {
+			return i - tb.index
+		}
+	}
+	return -1
+}
+
 // Peek returns a slice of l bytes from the buffer but does not advance the
 // internal pointer
 func (tb *timedBuffer) Peek(l int) []byte {
@@ -101,19 +212,23 @@ func (tb *timedBuffer) CurrentOffset() int {
 // CurrentTime returns the approximate timing of the next byte at the internal
 // pointer
 func (tb *timedBuffer) CurrentTime() time.Duration {
-	if tb.timingDirty {
-		log.Fatalf("Todo: sorting")
-	}
-	var rv time.Duration
-	for _, tc := range tb.timing {
-		if tc.i <= tb.index {
-			rv = tc.t
-		} else {
-			return rv
-		}
+	return tb.TimeAt(tb.index)
+}
+
+// TimeAt returns the approximate timing of the byte at offset i. Offsets
+// past the end of the buffer are placed just after the last segment.
+func (tb *timedBuffer) TimeAt(i int) time.Duration {
+	if i >= len(tb.buf) {
+		return tb.tmax + 1*time.Millisecond
 	}
 
-	return tb.tmax + 1*time.Millisecond
+	j := sort.Search(len(tb.timing), func(j int) bool {
+		return tb.timing[j].i > i
+	})
+	if j == 0 {
+		return 0
+	}
+	return tb.timing[j-1].t
 }
 
 // Remaining returns the amount of remaining data
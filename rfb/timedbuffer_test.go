@@ -0,0 +1,115 @@
+package rfb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTimedBufferAdd(t *testing.T) {
+	type segment struct {
+		t      time.Duration
+		offset int
+		data   string
+	}
+
+	tests := []struct {
+		name     string
+		segments []segment
+		// wantErr lists, for each segment, whether Add should fail
+		wantErr  []bool
+		data     string
+		received []span
+		// times maps offsets to the time TimeAt should return for them
+		times map[int]time.Duration
+	}{
+		{
+			name:     "in order",
+			segments: []segment{{1, 0, "abc"}, {2, 3, "def"}},
+			data:     "abcdef",
+			received: []span{{0, 6}},
+			times:    map[int]time.Duration{0: 1, 2: 1, 3: 2, 5: 2, 6: 2 + time.Millisecond},
+		},
+		{
+			name:     "reordered",
+			segments: []segment{{1, 3, "def"}, {2, 0, "abc"}},
+			data:     "abcdef",
+			received: []span{{0, 6}},
+			times:    map[int]time.Duration{0: 2, 2: 2, 3: 1, 5: 1},
+		},
+		{
+			name:     "retransmission",
+			segments: []segment{{1, 0, "abc"}, {2, 3, "def"}, {3, 0, "abc"}, {4, 3, "xyz"}},
+			data:     "abcdef",
+			received: []span{{0, 6}},
+			times:    map[int]time.Duration{0: 1, 3: 2, 6: 4 + time.Millisecond},
+		},
+		{
+			name:     "overlapping",
+			segments: []segment{{1, 0, "abcd"}, {2, 2, "xxef"}},
+			data:     "abcdef",
+			received: []span{{0, 6}},
+			times:    map[int]time.Duration{1: 1, 3: 1, 4: 2, 5: 2},
+		},
+		{
+			name:     "overlapping both ends of a gap",
+			segments: []segment{{1, 0, "ab"}, {2, 4, "ef"}, {3, 1, "xcdx"}},
+			data:     "abcdef",
+			received: []span{{0, 6}},
+			times:    map[int]time.Duration{1: 1, 2: 3, 3: 3, 4: 2},
+		},
+		{
+			name:     "gap",
+			segments: []segment{{1, 0, "ab"}, {2, 4, "ef"}},
+			data:     "ab\x6f\x6fef",
+			received: []span{{0, 2}, {4, 6}},
+			times:    map[int]time.Duration{0: 1, 3: 1, 4: 2},
+		},
+		{
+			name:     "several gaps filled",
+			segments: []segment{{1, 6, "gh"}, {2, 2, "cd"}, {3, 0, "ab"}, {4, 4, "ef"}},
+			data:     "abcdefgh",
+			received: []span{{0, 8}},
+			times:    map[int]time.Duration{0: 3, 2: 2, 4: 4, 6: 1, 7: 1},
+		},
+		{
+			name:     "before the start",
+			segments: []segment{{1, 0, "ab"}, {2, -2, "xx"}},
+			wantErr:  []bool{false, true},
+			data:     "ab",
+			received: []span{{0, 2}},
+		},
+		{
+			name:     "gap too large",
+			segments: []segment{{1, 0, "ab"}, {2, maxGap + 3, "xx"}},
+			wantErr:  []bool{false, true},
+			data:     "ab",
+			received: []span{{0, 2}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tb := newBuffer()
+			for i, seg := range tc.segments {
+				err := tb.Add(seg.t, seg.offset, []byte(seg.data))
+				wantErr := i < len(tc.wantErr) && tc.wantErr[i]
+				if (err != nil) != wantErr {
+					t.Errorf("segment %d: got error %v; want error: %v", i, err, wantErr)
+				}
+			}
+
+			if string(tb.buf) != tc.data {
+				t.Errorf("buffer contains %q; want %q", tb.buf, tc.data)
+			}
+			if !reflect.DeepEqual(tb.received, tc.received) {
+				t.Errorf("received %v; want %v", tb.received, tc.received)
+			}
+			for i, want := range tc.times {
+				if got := tb.TimeAt(i); got != want {
+					t.Errorf("TimeAt(%d) = %v; want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
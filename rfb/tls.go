@@ -0,0 +1,629 @@
+package rfb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TLS record content types
+const (
+	tlsChangeCipherSpec = 20
+	tlsAlert            = 21
+	tlsHandshake        = 22
+	tlsApplicationData  = 23
+)
+
+// TLS handshake message types
+const (
+	tlsClientHello       = 1
+	tlsServerHello       = 2
+	tlsClientKeyExchange = 16
+	tlsFinished          = 20
+)
+
+// TLS extensions
+const (
+	tlsExtEncryptThenMAC       = 22
+	tlsExtExtendedMasterSecret = 23
+	tlsExtSupportedVersions    = 43
+)
+
+const (
+	tls10 = 0x0301
+	tls11 = 0x0302
+	tls13 = 0x0304
+)
+
+var errNoTLSKeys = errors.New("no key material for this TLS session")
+
+// A KeyLog contains TLS secrets in the NSS key log format, as written by
+// browsers and TLS libraries that honour SSLKEYLOGFILE. Secrets are indexed
+// by label, and then by the hex-encoded client random.
+type KeyLog map[string]map[string][]byte
+
+// ParseKeyLog reads a TLS key log file
+func ParseKeyLog(r io.Reader) (KeyLog, error) {
+	rv := make(KeyLog)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret in key log: %s", err)
+		}
+		if rv[fields[0]] == nil {
+			rv[fields[0]] = make(map[string][]byte)
+		}
+		rv[fields[0]][strings.ToLower(fields[1])] = secret
+	}
+
+	return rv, scanner.Err()
+}
+
+func (kl KeyLog) secret(label string, clientRandom []byte) []byte {
+	if kl == nil {
+		return nil
+	}
+	return kl[label][hex.EncodeToString(clientRandom)]
+}
+
+// A tlsCipherSuite describes the parameters of a cipher suite that can be
+// decrypted
+type tlsCipherSuite struct {
+	keyLen int
+	// macLen is zero for AEAD ciphers
+	macLen int
+	// ivLen is the length of the implicit part of the IV
+	ivLen int
+	// cipher creates either a cipher.AEAD or a cipher.Block
+	cipher         func(key []byte) (interface{}, error)
+	hash           func() hash.Hash
+	rsaKeyExchange bool
+}
+
+func aesGCM(key []byte) (interface{}, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func aesCBC(key []byte) (interface{}, error) {
+	return aes.NewCipher(key)
+}
+
+func tripleDESCBC(key []byte) (interface{}, error) {
+	return des.NewTripleDESCipher(key)
+}
+
+var tlsCipherSuites = map[uint16]tlsCipherSuite{
+	// TLS 1.3
+	0x1301: {16, 0, 12, aesGCM, sha256.New, false},
+	0x1302: {32, 0, 12, aesGCM, sha512.New384, false},
+
+	// AES-GCM
+	0x009c: {16, 0, 4, aesGCM, sha256.New, true},
+	0x009d: {32, 0, 4, aesGCM, sha512.New384, true},
+	0x009e: {16, 0, 4, aesGCM, sha256.New, false},
+	0x009f: {32, 0, 4, aesGCM, sha512.New384, false},
+	0x00a6: {16, 0, 4, aesGCM, sha256.New, false},
+	0x00a7: {32, 0, 4, aesGCM, sha512.New384, false},
+	0xc02b: {16, 0, 4, aesGCM, sha256.New, false},
+	0xc02c: {32, 0, 4, aesGCM, sha512.New384, false},
+	0xc02f: {16, 0, 4, aesGCM, sha256.New, false},
+	0xc030: {32, 0, 4, aesGCM, sha512.New384, false},
+
+	// AES-CBC
+	0x002f: {16, 20, 16, aesCBC, sha256.New, true},
+	0x0035: {32, 20, 16, aesCBC, sha256.New, true},
+	0x003c: {16, 32, 16, aesCBC, sha256.New, true},
+	0x003d: {32, 32, 16, aesCBC, sha256.New, true},
+	0x0033: {16, 20, 16, aesCBC, sha256.New, false},
+	0x0034: {16, 20, 16, aesCBC, sha256.New, false},
+	0x0039: {32, 20, 16, aesCBC, sha256.New, false},
+	0x003a: {32, 20, 16, aesCBC, sha256.New, false},
+	0x0067: {16, 32, 16, aesCBC, sha256.New, false},
+	0x006b: {32, 32, 16, aesCBC, sha256.New, false},
+	0x006c: {16, 32, 16, aesCBC, sha256.New, false},
+	0x006d: {32, 32, 16, aesCBC, sha256.New, false},
+	0xc009: {16, 20, 16, aesCBC, sha256.New, false},
+	0xc00a: {32, 20, 16, aesCBC, sha256.New, false},
+	0xc013: {16, 20, 16, aesCBC, sha256.New, false},
+	0xc014: {32, 20, 16, aesCBC, sha256.New, false},
+	0xc018: {16, 20, 16, aesCBC, sha256.New, false},
+	0xc019: {32, 20, 16, aesCBC, sha256.New, false},
+	0xc027: {16, 32, 16, aesCBC, sha256.New, false},
+	0xc028: {32, 48, 16, aesCBC, sha512.New384, false},
+
+	// Triple DES
+	0x000a: {24, 20, 8, tripleDESCBC, sha256.New, true},
+	0x0016: {24, 20, 8, tripleDESCBC, sha256.New, false},
+	0x001b: {24, 20, 8, tripleDESCBC, sha256.New, false},
+}
+
+// A tlsRecord is a single TLS record, along with the time its first byte was
+// captured
+type tlsRecord struct {
+	fromClient  bool
+	t           time.Duration
+	contentType byte
+	header      []byte
+	body        []byte
+}
+
+// tlsDirection holds the decryption state for one side of the connection
+type tlsDirection struct {
+	active bool
+	aead   cipher.AEAD
+	block  cipher.Block
+	iv     []byte
+	seq    uint64
+
+	// handshake contains handshake messages that have not been completely
+	// received yet
+	handshake []byte
+	// out receives the decrypted application data
+	out *timedBuffer
+}
+
+// A tlsSession decrypts a captured TLS session
+type tlsSession struct {
+	keyLog KeyLog
+	rsaKey *rsa.PrivateKey
+
+	version              uint16
+	suite                tlsCipherSuite
+	suiteID              uint16
+	clientRandom         []byte
+	serverRandom         []byte
+	encryptThenMAC       bool
+	extendedMasterSecret bool
+	transcript           bytes.Buffer
+	sessionHash          []byte
+	preMasterSecret      []byte
+	keyBlock             []byte
+
+	client, server tlsDirection
+}
+
+// Decrypt reads the TLS records in the remainder of both buffers, and
+// returns new buffers containing the decrypted application data. Each
+// record's contents keep the timing of the record they were sent in.
+func (s *tlsSession) Decrypt(clientBuffer, serverBuffer *timedBuffer) (*timedBuffer, *timedBuffer, error) {
+	records := append(readTLSRecords(clientBuffer, true), readTLSRecords(serverBuffer, false)...)
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].t < records[j].t
+	})
+
+	s.client.out = newBuffer()
+	s.server.out = newBuffer()
+
+	for _, rec := range records {
+		if err := s.processRecord(rec); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return s.client.out, s.server.out, nil
+}
+
+// readTLSRecords splits the remainder of a buffer into TLS records
+func readTLSRecords(tb *timedBuffer, fromClient bool) []tlsRecord {
+	var rv []tlsRecord
+
+	start := tb.CurrentOffset()
+	buf := tb.Consume(tb.Remaining())
+	for offset := 0; offset+5 <= len(buf); {
+		l := rInt(buf[offset+3 : offset+5])
+		if offset+5+l > len(buf) {
+			log.Printf("Warning: TLS record truncated")
+			break
+		}
+		rv = append(rv, tlsRecord{
+			fromClient:  fromClient,
+			t:           tb.TimeAt(start + offset),
+			contentType: buf[offset],
+			header:      buf[offset : offset+5],
+			body:        buf[offset+5 : offset+5+l],
+		})
+		offset += 5 + l
+	}
+
+	return rv
+}
+
+func (s *tlsSession) processRecord(rec tlsRecord) error {
+	dir := &s.server
+	if rec.fromClient {
+		dir = &s.client
+	}
+
+	if rec.contentType == tlsChangeCipherSpec {
+		if s.version == tls13 {
+			// Sent for middlebox compatibility only
+			return nil
+		}
+		return s.activate(dir, rec.fromClient)
+	}
+
+	contentType := rec.contentType
+	body := rec.body
+	if dir.active {
+		var err error
+		contentType, body, err = s.decryptRecord(dir, rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	if contentType == tlsHandshake {
+		return s.processHandshake(dir, rec.fromClient, body)
+	} else if contentType == tlsApplicationData {
+		dir.out.Add(rec.t, len(dir.out.buf), body)
+	}
+
+	return nil
+}
+
+// processHandshake reads the handshake messages in a record. Only the
+// messages needed to derive the keys are interpreted.
+func (s *tlsSession) processHandshake(dir *tlsDirection, fromClient bool, body []byte) error {
+	dir.handshake = append(dir.handshake, body...)
+
+	for len(dir.handshake) >= 4 {
+		l := rInt(dir.handshake[1:4])
+		if len(dir.handshake) < 4+l {
+			break
+		}
+		msg := dir.handshake[:4+l]
+		dir.handshake = dir.handshake[4+l:]
+
+		if !dir.active {
+			s.transcript.Write(msg)
+		}
+
+		var err error
+		switch msg[0] {
+		case tlsClientHello:
+			if len(msg) >= 38 {
+				s.clientRandom = msg[6:38]
+			}
+		case tlsServerHello:
+			err = s.parseServerHello(msg[4:])
+		case tlsClientKeyExchange:
+			err = s.parseClientKeyExchange(msg[4:])
+		case tlsFinished:
+			if s.version == tls13 {
+				err = s.switchToTrafficKeys(dir, fromClient)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *tlsSession) parseServerHello(msg []byte) error {
+	if len(msg) < 38 {
+		return fmt.Errorf("TLS ServerHello truncated")
+	}
+	s.version = uint16(rInt(msg[0:2]))
+	s.serverRandom = msg[2:34]
+
+	offset := 35 + int(msg[34])
+	if offset+3 > len(msg) {
+		return fmt.Errorf("TLS ServerHello truncated")
+	}
+	s.suiteID = uint16(rInt(msg[offset : offset+2]))
+	offset += 3
+
+	// Extensions
+	if offset+2 <= len(msg) {
+		end := offset + 2 + rInt(msg[offset:offset+2])
+		offset += 2
+		for offset+4 <= end && end <= len(msg) {
+			extType := rInt(msg[offset : offset+2])
+			extLen := rInt(msg[offset+2 : offset+4])
+			ext := msg[offset+4 : offset+4+extLen]
+			offset += 4 + extLen
+
+			if extType == tlsExtSupportedVersions && len(ext) == 2 {
+				s.version = uint16(rInt(ext))
+			} else if extType == tlsExtEncryptThenMAC {
+				s.encryptThenMAC = true
+			} else if extType == tlsExtExtendedMasterSecret {
+				s.extendedMasterSecret = true
+			}
+		}
+	}
+
+	suite, ok := tlsCipherSuites[s.suiteID]
+	if !ok {
+		return fmt.Errorf("TLS cipher suite %04x is not supported", s.suiteID)
+	}
+	s.suite = suite
+
+	if s.version == tls13 {
+		// All further handshake messages are encrypted
+		if err := s.setKeys13(&s.client, "CLIENT_HANDSHAKE_TRAFFIC_SECRET"); err != nil {
+			return err
+		}
+		return s.setKeys13(&s.server, "SERVER_HANDSHAKE_TRAFFIC_SECRET")
+	}
+
+	return nil
+}
+
+func (s *tlsSession) parseClientKeyExchange(msg []byte) error {
+	s.sessionHash = s.prfHash(s.transcript.Bytes())
+
+	if !s.suite.rsaKeyExchange || s.rsaKey == nil {
+		return nil
+	}
+
+	encrypted := msg
+	if s.version > 0x0300 && len(msg) >= 2 {
+		encrypted = msg[2:]
+	}
+	pre, err := rsa.DecryptPKCS1v15(rand.Reader, s.rsaKey, encrypted)
+	if err != nil {
+		return fmt.Errorf("error decrypting TLS pre-master secret: %s", err)
+	}
+	s.preMasterSecret = pre
+	return nil
+}
+
+// masterSecret returns the master secret of a TLS 1.2 or earlier session,
+// either from the key log or from the decrypted pre-master secret
+func (s *tlsSession) masterSecret() ([]byte, error) {
+	if secret := s.keyLog.secret("CLIENT_RANDOM", s.clientRandom); secret != nil {
+		return secret, nil
+	}
+	if s.preMasterSecret == nil {
+		return nil, errNoTLSKeys
+	}
+
+	if s.extendedMasterSecret {
+		return s.prf(s.preMasterSecret, "extended master secret", s.sessionHash, 48), nil
+	}
+	return s.prf(s.preMasterSecret, "master secret", concat(s.clientRandom, s.serverRandom), 48), nil
+}
+
+// activate starts decrypting records from one side, after it has sent its
+// ChangeCipherSpec
+func (s *tlsSession) activate(dir *tlsDirection, fromClient bool) error {
+	if s.keyBlock == nil {
+		master, err := s.masterSecret()
+		if err != nil {
+			return err
+		}
+		l := 2*s.suite.macLen + 2*s.suite.keyLen + 2*s.suite.ivLen
+		s.keyBlock = s.prf(master, "key expansion", concat(s.serverRandom, s.clientRandom), l)
+	}
+
+	offset, keyLen := 2*s.suite.macLen, s.suite.keyLen
+	ivOffset, ivLen := offset+2*keyLen, s.suite.ivLen
+	if !fromClient {
+		offset += keyLen
+		ivOffset += ivLen
+	}
+
+	c, err := s.suite.cipher(s.keyBlock[offset : offset+keyLen])
+	if err != nil {
+		return err
+	}
+	dir.aead, _ = c.(cipher.AEAD)
+	dir.block, _ = c.(cipher.Block)
+	dir.iv = append([]byte{}, s.keyBlock[ivOffset:ivOffset+ivLen]...)
+	dir.seq = 0
+	dir.active = true
+	return nil
+}
+
+// setKeys13 sets up TLS 1.3 decryption using the secret with the given label
+func (s *tlsSession) setKeys13(dir *tlsDirection, label string) error {
+	secret := s.keyLog.secret(label, s.clientRandom)
+	if secret == nil {
+		return errNoTLSKeys
+	}
+
+	key := hkdfExpandLabel(s.suite.hash, secret, "key", s.suite.keyLen)
+	c, err := s.suite.cipher(key)
+	if err != nil {
+		return err
+	}
+	dir.aead = c.(cipher.AEAD)
+	dir.iv = hkdfExpandLabel(s.suite.hash, secret, "iv", s.suite.ivLen)
+	dir.seq = 0
+	dir.active = true
+	return nil
+}
+
+func (s *tlsSession) switchToTrafficKeys(dir *tlsDirection, fromClient bool) error {
+	if fromClient {
+		return s.setKeys13(dir, "CLIENT_TRAFFIC_SECRET_0")
+	}
+	return s.setKeys13(dir, "SERVER_TRAFFIC_SECRET_0")
+}
+
+// decryptRecord decrypts a single record, and returns its content type and
+// plaintext
+func (s *tlsSession) decryptRecord(dir *tlsDirection, rec tlsRecord) (byte, []byte, error) {
+	defer func() {
+		dir.seq++
+	}()
+
+	var seq [8]byte
+	for i := range seq {
+		seq[i] = byte(dir.seq >> uint(56-8*i))
+	}
+
+	body := rec.body
+	if s.version == tls13 {
+		nonce := append([]byte{}, dir.iv...)
+		for i := range seq {
+			nonce[len(nonce)-8+i] ^= seq[i]
+		}
+		plain, err := dir.aead.Open(nil, nonce, body, rec.header)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error decrypting TLS record: %s", err)
+		}
+
+		// Strip the padding; the real content type is the last nonzero byte
+		i := len(plain) - 1
+		for i >= 0 && plain[i] == 0 {
+			i--
+		}
+		if i < 0 {
+			return 0, nil, fmt.Errorf("error decrypting TLS record: no content type")
+		}
+		return plain[i], plain[:i], nil
+	}
+
+	if dir.aead != nil {
+		if len(body) < 8+dir.aead.Overhead() {
+			return 0, nil, fmt.Errorf("error decrypting TLS record: record too short")
+		}
+		nonce := concat(dir.iv, body[:8])
+		ciphertext := body[8:]
+		l := len(ciphertext) - dir.aead.Overhead()
+		aad := concat(seq[:], rec.header[0:3], []byte{byte(l >> 8), byte(l)})
+
+		plain, err := dir.aead.Open(nil, nonce, ciphertext, aad)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error decrypting TLS record: %s", err)
+		}
+		return rec.contentType, plain, nil
+	}
+
+	// CBC mode. The MAC is not verified.
+	bs := dir.block.BlockSize()
+	if s.encryptThenMAC {
+		if len(body) < s.suite.macLen {
+			return 0, nil, fmt.Errorf("error decrypting TLS record: record too short")
+		}
+		body = body[:len(body)-s.suite.macLen]
+	}
+
+	iv := dir.iv
+	if s.version >= tls11 {
+		if len(body) < bs {
+			return 0, nil, fmt.Errorf("error decrypting TLS record: record too short")
+		}
+		iv, body = body[:bs], body[bs:]
+	}
+	if len(body) == 0 || len(body)%bs != 0 {
+		return 0, nil, fmt.Errorf("error decrypting TLS record: invalid length")
+	}
+	if s.version < tls11 {
+		// TLS 1.0 chains the IV from one record to the next
+		dir.iv = append([]byte{}, body[len(body)-bs:]...)
+	}
+
+	plain := make([]byte, len(body))
+	cipher.NewCBCDecrypter(dir.block, iv).CryptBlocks(plain, body)
+
+	l := len(plain) - int(plain[len(plain)-1]) - 1
+	if !s.encryptThenMAC {
+		l -= s.suite.macLen
+	}
+	if l < 0 {
+		return 0, nil, fmt.Errorf("error decrypting TLS record: invalid padding")
+	}
+	return rec.contentType, plain[:l], nil
+}
+
+// prf is the pseudo-random function used in TLS 1.2 and earlier
+func (s *tlsSession) prf(secret []byte, label string, seed []byte, l int) []byte {
+	labelSeed := concat([]byte(label), seed)
+	if s.version >= 0x0303 {
+		return pHash(s.suite.hash, secret, labelSeed, l)
+	}
+
+	// TLS 1.0 and 1.1 combine MD5 and SHA-1, each using half of the secret
+	half := (len(secret) + 1) / 2
+	rv := pHash(md5.New, secret[:half], labelSeed, l)
+	sha := pHash(sha1.New, secret[len(secret)-half:], labelSeed, l)
+	for i := range rv {
+		rv[i] ^= sha[i]
+	}
+	return rv
+}
+
+// prfHash hashes the handshake transcript for the extended master secret
+func (s *tlsSession) prfHash(b []byte) []byte {
+	if s.version >= 0x0303 {
+		h := s.suite.hash()
+		h.Write(b)
+		return h.Sum(nil)
+	}
+	m, sh := md5.Sum(b), sha1.Sum(b)
+	return concat(m[:], sh[:])
+}
+
+func pHash(h func() hash.Hash, secret, seed []byte, l int) []byte {
+	rv := make([]byte, 0, l)
+	a := seed
+	for len(rv) < l {
+		m := hmac.New(h, secret)
+		m.Write(a)
+		a = m.Sum(nil)
+
+		m = hmac.New(h, secret)
+		m.Write(a)
+		m.Write(seed)
+		rv = append(rv, m.Sum(nil)...)
+	}
+	return rv[:l]
+}
+
+// hkdfExpandLabel derives TLS 1.3 keys from a traffic secret
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, l int) []byte {
+	fullLabel := "tls13 " + label
+	info := concat([]byte{byte(l >> 8), byte(l), byte(len(fullLabel))}, []byte(fullLabel), []byte{0})
+
+	var rv, t []byte
+	for i := byte(1); len(rv) < l; i++ {
+		m := hmac.New(h, secret)
+		m.Write(t)
+		m.Write(info)
+		m.Write([]byte{i})
+		t = m.Sum(nil)
+		rv = append(rv, t...)
+	}
+	return rv[:l]
+}
+
+func concat(parts ...[]byte) []byte {
+	var rv []byte
+	for _, p := range parts {
+		rv = append(rv, p...)
+	}
+	return rv
+}
@@ -0,0 +1,243 @@
+package rfb
+
+import (
+	"bufio"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	rv, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rv
+}
+
+func TestPRF(t *testing.T) {
+	tests := []struct {
+		name    string
+		version uint16
+		hash    func() hash.Hash
+		secret  string
+		label   string
+		seed    string
+		want    string
+	}{
+		{
+			// The TLS 1.2 PRF test vector posted to the IETF TLS working
+			// group, which matches `openssl kdf TLS1-PRF`
+			name:    "TLS 1.2 SHA-256",
+			version: 0x0303,
+			hash:    sha256.New,
+			secret:  "9bbe436ba940f017b17652849a71db35",
+			label:   "test label",
+			seed:    "a0ba9f936cda311827a6f796ffd5198c",
+			want: `e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a
+				6b301791e90d35c9c9a46b4e14baf9af0fa022f7077def17abfd3797c0564bab
+				4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff701
+				87347b66`,
+		},
+		{
+			// openssl kdf -keylen 148 -kdfopt digest:SHA384 ... TLS1-PRF
+			name:    "TLS 1.2 SHA-384",
+			version: 0x0303,
+			hash:    sha512.New384,
+			secret:  "b80b733d6ceefcdc71566ea48e5567df",
+			label:   "test label",
+			seed:    "cd665cf6a8447dd6ff8b27555edb7465",
+			want: `7b0c18e9ced410ed1804f2cfa34a336a1c14dffb4900bb5fd7942107e81c83cd
+				e9ca0faa60be9fe34f82b1233c9146a0e534cb400fed2700884f9dc236f80edd
+				8bfa961144c9e8d792eca722a7b32fc3d416d473ebc2c5fd4abfdad05d918425
+				9b5bf8cd4d90fa0d31e2dec479e4f1a26066f2eea9a69236a3e52655c9e9aee6
+				91c8f3a26854308d5eaa3be85e0990703d73e56f`,
+		},
+		{
+			// openssl kdf -keylen 64 -kdfopt digest:MD5-SHA1 ... TLS1-PRF
+			name:    "TLS 1.0 MD5 and SHA-1",
+			version: tls10,
+			secret: `bded7fa5c1699c010be23dd06ada3a48349f21e5f86263d512c0c5cc379f0e78
+				0ec55d9844b2f1db02a96453513568d0`,
+			label: "master secret",
+			seed:  "00112233",
+			want: `dd4d520e4c59b91469a90973ce6c5e5963a8f7559d8a491491c1b2d124388954
+				b8501f639bc57d41b5bceb76183f849c7cb9ae4509117a87ed9954a43e63bd91`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &tlsSession{version: tc.version, suite: tlsCipherSuite{hash: tc.hash}}
+			want := mustHex(t, tc.want)
+			got := s.prf(mustHex(t, tc.secret), tc.label, mustHex(t, tc.seed), len(want))
+			if hex.EncodeToString(got) != hex.EncodeToString(want) {
+				t.Errorf("got  %x\nwant %x", got, want)
+			}
+		})
+	}
+}
+
+func TestHKDFExpandLabel(t *testing.T) {
+	tests := []struct {
+		name   string
+		hash   func() hash.Hash
+		secret string
+		label  string
+		want   string
+	}{
+		{
+			// RFC 8448 section 3, server handshake write key and IV
+			name:   "RFC 8448 key",
+			hash:   sha256.New,
+			secret: "b67b7d690cc16c4e75e54213cb2d37b4e9c912bcded9105d42befd59d391ad38",
+			label:  "key",
+			want:   "3fce516009c21727d0f2e4e86ee403bc",
+		},
+		{
+			name:   "RFC 8448 iv",
+			hash:   sha256.New,
+			secret: "b67b7d690cc16c4e75e54213cb2d37b4e9c912bcded9105d42befd59d391ad38",
+			label:  "iv",
+			want:   "5d313eb2671276ee13000b30",
+		},
+		{
+			// openssl kdf -kdfopt digest:SHA384 -kdfopt mode:EXPAND_ONLY ... TLS13-KDF
+			name: "SHA-384 key",
+			hash: sha512.New384,
+			secret: `000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f
+				202122232425262728292a2b2c2d2e2f`,
+			label: "key",
+			want:  "6877d022f1c61d24ebb7487c16752d9a4798e40431c75b39320e537c90e23225",
+		},
+		{
+			name: "SHA-384 iv",
+			hash: sha512.New384,
+			secret: `000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f
+				202122232425262728292a2b2c2d2e2f`,
+			label: "iv",
+			want:  "42822531a0fe88648fc09e9f",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			want := mustHex(t, tc.want)
+			got := hkdfExpandLabel(tc.hash, mustHex(t, tc.secret), tc.label, len(want))
+			if hex.EncodeToString(got) != hex.EncodeToString(want) {
+				t.Errorf("got  %x\nwant %x", got, want)
+			}
+		})
+	}
+}
+
+// readTLSTranscript reads a session recorded between openssl s_client and
+// s_server. The file contains the client's key log, followed by the bytes
+// each side sent in "client <hex>" and "server <hex>" lines, in the order
+// they were sent.
+func readTLSTranscript(t *testing.T, name string) (KeyLog, *timedBuffer, *timedBuffer) {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "tls", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	keyLog, err := ParseKeyLog(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(0, 0)
+
+	client, server := newBuffer(), newBuffer()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for i := 0; scanner.Scan(); i++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		tb := client
+		if fields[0] == "server" {
+			tb = server
+		}
+		tb.Add(time.Duration(i)*time.Millisecond, len(tb.buf), mustHex(t, fields[1]))
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return keyLog, client, server
+}
+
+func readTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	buf, err := os.ReadFile(filepath.Join("testdata", "tls", "server-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(buf)
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.(*rsa.PrivateKey)
+}
+
+func TestTLSDecrypt(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		// useRSAKey decrypts the session using the server's private key
+		// rather than the key log
+		useRSAKey      bool
+		version        uint16
+		suite          uint16
+		encryptThenMAC bool
+	}{
+		{"TLS 1.2 AES-GCM", "tls12-gcm.txt", false, 0x0303, 0xc02f, false},
+		{"TLS 1.2 AES-CBC", "tls12-cbc.txt", false, 0x0303, 0xc013, false},
+		{"TLS 1.2 AES-CBC encrypt-then-MAC", "tls12-cbc-etm.txt", false, 0x0303, 0xc028, true},
+		{"TLS 1.2 RSA key exchange", "tls12-rsa-cbc.txt", false, 0x0303, 0x003c, true},
+		{"TLS 1.2 RSA private key", "tls12-rsa-cbc.txt", true, 0x0303, 0x003c, true},
+		{"TLS 1.3 AES-128-GCM", "tls13-aes128.txt", false, tls13, 0x1301, false},
+		{"TLS 1.3 AES-256-GCM", "tls13-aes256.txt", false, tls13, 0x1302, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			keyLog, clientBuffer, serverBuffer := readTLSTranscript(t, tc.file)
+			s := &tlsSession{keyLog: keyLog}
+			if tc.useRSAKey {
+				s.keyLog = nil
+				s.rsaKey = readTestRSAKey(t)
+			}
+
+			client, server, err := s.Decrypt(clientBuffer, serverBuffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.version != tc.version || s.suiteID != tc.suite || s.encryptThenMAC != tc.encryptThenMAC {
+				t.Errorf("version %04x, cipher suite %04x, encrypt-then-MAC %v; want %04x, %04x, %v", s.version, s.suiteID, s.encryptThenMAC, tc.version, tc.suite, tc.encryptThenMAC)
+			}
+
+			// The client sends a line, which s_server -rev sends back
+			// reversed
+			if got := string(client.Consume(client.Remaining())); got != "hello vnc\n" {
+				t.Errorf("client sent %q; want %q", got, "hello vnc\n")
+			}
+			if got := string(server.Consume(server.Remaining())); got != "cnv olleh\n" {
+				t.Errorf("server sent %q; want %q", got, "cnv olleh\n")
+			}
+		})
+	}
+}
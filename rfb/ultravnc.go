@@ -0,0 +1,160 @@
+package rfb
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"fmt"
+	"html"
+	"math"
+	"math/big"
+	"math/bits"
+)
+
+// repeaterVersion is the ProtocolVersion message an UltraVNC repeater sends
+// to a viewer
+var repeaterVersion = []byte("RFB 000.000\n")
+
+// repeaterIDLength is the length of the block in which a peer tells the
+// repeater which connection it wants
+const repeaterIDLength = 250
+
+// consumeRepeaterPrologue reads the messages exchanged with an UltraVNC
+// repeater, if the connection was routed through one. These precede the
+// RFB handshake.
+func (rfb *RFB) consumeRepeaterPrologue() {
+	if bytes.Equal(rfb.serverBuffer.Peek(len(repeaterVersion)), repeaterVersion) {
+		rfb.nextS(len(repeaterVersion))
+
+		// The viewer replies with either an ID, or the host and port of the
+		// server to connect to
+		rfb.readRepeaterID(rfb.nextC(repeaterIDLength))
+	}
+
+	// In captures between the repeater and a server, the server identifies
+	// itself first
+	if bytes.HasPrefix(rfb.serverBuffer.Peek(repeaterIDLength), []byte("ID:")) {
+		rfb.readRepeaterID(rfb.nextS(repeaterIDLength))
+	}
+	if bytes.HasPrefix(rfb.clientBuffer.Peek(repeaterIDLength), []byte("ID:")) {
+		rfb.readRepeaterID(rfb.nextC(repeaterIDLength))
+	}
+}
+
+func (rfb *RFB) readRepeaterID(buf []byte) {
+	id := cString(buf)
+	if bytes.HasPrefix(buf, []byte("ID:")) {
+		rfb.auth.RepeaterID = id[3:]
+		fmt.Fprintf(rfb.htmlOut, "<div>UltraVNC repeater ID: <tt>%s</tt></div>\n", html.EscapeString(rfb.auth.RepeaterID))
+	} else {
+		fmt.Fprintf(rfb.htmlOut, "<div>UltraVNC repeater destination: <tt>%s</tt></div>\n", html.EscapeString(id))
+	}
+}
+
+// consumeMSLogonII reads the UltraVNC MS-Logon II authentication exchange
+// (security type 113). The client encrypts the username and password using
+// a key from a 64-bit Diffie-Hellman exchange. UltraVNC picks such small
+// parameters that the private values can usually be recovered.
+func (rfb *RFB) consumeMSLogonII() error {
+	params := rfb.nextS(24)
+	if len(params) != 24 {
+		return fmt.Errorf("handshake failed: MS-Logon II parameters truncated")
+	}
+	generator := new(big.Int).SetBytes(params[0:8])
+	prime := new(big.Int).SetBytes(params[8:16])
+	serverKey := new(big.Int).SetBytes(params[16:24])
+
+	clientKey := new(big.Int).SetBytes(rfb.nextC(8))
+	user := rfb.nextC(256)
+	password := rfb.nextC(64)
+	if len(user) != 256 || len(password) != 64 {
+		return fmt.Errorf("handshake failed: MS-Logon II credentials truncated")
+	}
+
+	fmt.Fprintf(rfb.htmlOut, "<div>MS-Logon II authentication: %d-bit Diffie-Hellman, generator %s</div>\n", prime.BitLen(), generator)
+
+	secret, err := dhSharedSecret(generator, prime, serverKey, clientKey, rfb.DHPrivateKeys)
+	if err != nil {
+		fmt.Fprintf(rfb.htmlOut, "<div>Not decrypting MS-Logon II credentials: %s</div>\n", html.EscapeString(err.Error()))
+		return nil
+	} else if secret == nil {
+		if priv := dhDiscreteLog(generator, prime, serverKey); priv != nil {
+			secret = new(big.Int).Exp(clientKey, priv, prime)
+		}
+	}
+	if secret == nil {
+		return nil
+	}
+
+	key := leftPad(secret.Bytes(), 8)
+	rfb.auth.Username = cString(decryptUltraVNC(user, key))
+	rfb.auth.Password = cString(decryptUltraVNC(password, key))
+	rfb.auth.PasswordFound = true
+	fmt.Fprintf(rfb.htmlOut, "<div>MS-Logon II credentials decrypted</div>\n")
+
+	return nil
+}
+
+// decryptUltraVNC decrypts data encrypted by UltraVNC's vncEncryptBytes2,
+// which is DES in CBC mode that uses the key as its IV. Like VNC
+// authentication, it reverses the bit order of each key byte.
+func decryptUltraVNC(buf, key []byte) []byte {
+	var desKey [8]byte
+	for i := range desKey {
+		desKey[i] = bits.Reverse8(key[i])
+	}
+	block, err := des.NewCipher(desKey[:])
+	if err != nil {
+		return nil
+	}
+
+	rv := make([]byte, len(buf)-len(buf)%des.BlockSize)
+	cipher.NewCBCDecrypter(block, key[:des.BlockSize]).CryptBlocks(rv, buf[:len(rv)])
+	return rv
+}
+
+// dhDiscreteLog recovers a Diffie-Hellman private value from the public
+// value, using the baby-step giant-step algorithm. This is only feasible
+// for small primes; it returns nil for primes over 40 bits.
+func dhDiscreteLog(generator, prime, public *big.Int) *big.Int {
+	if prime.BitLen() > 40 || prime.Cmp(big.NewInt(2)) < 0 {
+		return nil
+	}
+	p := prime.Uint64()
+	g := new(big.Int).Mod(generator, prime).Uint64()
+	y := new(big.Int).Mod(public, prime).Uint64()
+
+	m := uint64(math.Sqrt(float64(p))) + 1
+
+	// Baby steps: g^j for 0 <= j < m
+	table := make(map[uint64]uint64, m)
+	e := uint64(1)
+	for j := uint64(0); j < m; j++ {
+		if _, ok := table[e]; !ok {
+			table[e] = j
+		}
+		e = mulMod(e, g, p)
+	}
+
+	// Giant steps: y * g^(-im) for 0 <= i < m
+	inv := new(big.Int).ModInverse(new(big.Int).Exp(generator, new(big.Int).SetUint64(m), prime), prime)
+	if inv == nil {
+		return nil
+	}
+	factor := inv.Uint64()
+	for i := uint64(0); i < m; i++ {
+		if j, ok := table[y]; ok {
+			return new(big.Int).SetUint64(i*m + j)
+		}
+		y = mulMod(y, factor, p)
+	}
+
+	return nil
+}
+
+// mulMod returns a*b mod m, for a and b smaller than m
+func mulMod(a, b, m uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	_, rem := bits.Div64(hi, lo, m)
+	return rem
+}
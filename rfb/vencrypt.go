@@ -0,0 +1,102 @@
+package rfb
+
+import (
+	"fmt"
+)
+
+// VeNCrypt subtypes
+const (
+	vencryptPlain     = 256
+	vencryptTLSNone   = 257
+	vencryptTLSVnc    = 258
+	vencryptTLSPlain  = 259
+	vencryptX509None  = 260
+	vencryptX509Vnc   = 261
+	vencryptX509Plain = 262
+)
+
+// consumeVeNCrypt reads the VeNCrypt negotiation, and the authentication
+// exchange of the chosen subtype. Most subtypes wrap the rest of the session
+// in TLS, which can be decrypted if a key log or private key is supplied.
+func (rfb *RFB) consumeVeNCrypt() error {
+	serverVersion := rfb.nextS(2)
+	clientVersion := rfb.nextC(2)
+	if len(serverVersion) != 2 || len(clientVersion) != 2 {
+		return fmt.Errorf("handshake failed: VeNCrypt version truncated")
+	}
+	if clientVersion[0] != 0 || clientVersion[1] != 2 {
+		return fmt.Errorf("handshake failed: VeNCrypt version %d.%d not supported", clientVersion[0], clientVersion[1])
+	}
+
+	if status := rInt(rfb.nextS(1)); status != 0 {
+		return fmt.Errorf("handshake failed: server rejected VeNCrypt version")
+	}
+
+	nSubtypes := rInt(rfb.nextS(1))
+	_ = rfb.nextS(4 * nSubtypes)
+	subtype := rInt(rfb.nextC(4))
+	fmt.Fprintf(rfb.htmlOut, "<div>VeNCrypt subtype %d</div>\n", subtype)
+
+	// The server acknowledges the subtype. Servers differ on whether they
+	// do this for Plain, but the SecurityResult that follows it could never
+	// start with 1.
+	if subtype != vencryptPlain || rInt(rfb.serverBuffer.Peek(1)) == 1 {
+		if ack := rInt(rfb.nextS(1)); ack != 1 {
+			return fmt.Errorf("handshake failed: server rejected VeNCrypt subtype %d", subtype)
+		}
+	}
+
+	if subtype != vencryptPlain {
+		if err := rfb.startTLS(); err != nil {
+			return err
+		}
+	}
+
+	switch subtype {
+	case vencryptTLSNone, vencryptX509None:
+		return nil
+	case vencryptTLSVnc, vencryptX509Vnc:
+		rfb.consumeVNCAuth()
+		return nil
+	case vencryptPlain, vencryptTLSPlain, vencryptX509Plain:
+		return rfb.consumePlainAuth()
+	}
+
+	fmt.Fprintf(rfb.htmlOut, "<div class=\"-todo\">VeNCrypt subtype %d not implemented - skipping to ServerInit</div>\n", subtype)
+	return errUnknownSecurity
+}
+
+// consumePlainAuth reads the username and password of VeNCrypt's Plain
+// authentication
+func (rfb *RFB) consumePlainAuth() error {
+	lengths := rfb.nextC(8)
+	if len(lengths) != 8 {
+		return fmt.Errorf("handshake failed: Plain authentication truncated")
+	}
+	rfb.auth.Username = string(rfb.nextC(rInt(lengths[0:4])))
+	rfb.auth.Password = string(rfb.nextC(rInt(lengths[4:8])))
+	rfb.auth.PasswordFound = true
+	fmt.Fprintf(rfb.htmlOut, "<div>Plain authentication: username and password sent in the clear</div>\n")
+	return nil
+}
+
+// startTLS decrypts the remainder of the session, from the start of a TLS
+// handshake
+func (rfb *RFB) startTLS() error {
+	if rfb.TLSKeyLog == nil && rfb.TLSPrivateKey == nil {
+		return fmt.Errorf("handshake failed: the session is encrypted using TLS; supply a key log or private key to decrypt it")
+	}
+
+	s := &tlsSession{
+		keyLog: rfb.TLSKeyLog,
+		rsaKey: rfb.TLSPrivateKey,
+	}
+	client, server, err := s.Decrypt(rfb.clientBuffer, rfb.serverBuffer)
+	if err != nil {
+		return fmt.Errorf("handshake failed: %s", err)
+	}
+	rfb.clientBuffer, rfb.serverBuffer = client, server
+
+	fmt.Fprintf(rfb.htmlOut, "<div>Decrypted TLS session: version %04x, cipher suite %04x</div>\n", s.version, s.suiteID)
+	return nil
+}
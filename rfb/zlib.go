@@ -0,0 +1,137 @@
+package rfb
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+)
+
+// An inflateStream is a zlib stream that continues across rectangles and
+// framebuffer updates. Compressed data is fed to it as it is encountered, and
+// the decompressor picks up where it left off.
+type inflateStream struct {
+	input  bytes.Buffer
+	reader io.ReadCloser
+
+	// Used by InflateFlushed only
+	started bool
+	window  []byte
+}
+
+// Write adds compressed data to the stream
+func (z *inflateStream) Write(compressed []byte) (int, error) {
+	return z.input.Write(compressed)
+}
+
+// Read reads uncompressed data from the stream. Callers should never try to
+// read beyond the data that has been written to the stream so far.
+func (z *inflateStream) Read(p []byte) (int, error) {
+	if z.reader == nil {
+		r, err := zlib.NewReader(&z.input)
+		if err != nil {
+			z.Reset()
+			return 0, fmt.Errorf("error initialising zlib stream: %s", err)
+		}
+		z.reader = r
+	}
+
+	n, err := z.reader.Read(p)
+	if err != nil {
+		// The stream is no longer usable beyond this point
+		z.Reset()
+		return n, fmt.Errorf("error inflating zlib stream: %s", err)
+	}
+
+	return n, nil
+}
+
+// Inflate adds compressed data to the stream and reads l bytes of
+// uncompressed data.
+func (z *inflateStream) Inflate(compressed []byte, l int) ([]byte, error) {
+	z.Write(compressed)
+
+	rv := make([]byte, l)
+	n, err := io.ReadFull(z, rv)
+	return rv[:n], err
+}
+
+// InflateFlushed adds compressed data to the stream and returns all of the
+// uncompressed data it holds. This relies on the compressor flushing its
+// output at the end of each write, which ZRLE servers do for every rectangle.
+// Since everything is read at once, a decoding error in one rectangle doesn't
+// leave the rest of it behind in the stream. Don't mix this with Read.
+func (z *inflateStream) InflateFlushed(compressed []byte) ([]byte, error) {
+	if !z.started {
+		if len(compressed) < 2 || compressed[0]&0x0f != 8 || compressed[1]&0x20 != 0 || (int(compressed[0])<<8|int(compressed[1]))%31 != 0 {
+			return nil, fmt.Errorf("error initialising zlib stream: invalid header")
+		}
+		compressed = compressed[2:]
+		z.started = true
+	}
+
+	// The data ends on a byte boundary after a flush, so the decompressor can
+	// be stopped cleanly by adding an empty final block. It continues with
+	// the next write using the data inflated so far as its dictionary.
+	input := io.MultiReader(bytes.NewReader(compressed), bytes.NewReader(finalDeflateBlock))
+	if z.reader == nil {
+		z.reader = flate.NewReaderDict(input, z.window)
+	} else {
+		z.reader.(flate.Resetter).Reset(input, z.window)
+	}
+
+	rv, err := ioutil.ReadAll(z.reader)
+	if err != nil {
+		// The stream is no longer usable beyond this point
+		z.Reset()
+		return rv, fmt.Errorf("error inflating zlib stream: %s", err)
+	}
+
+	z.window = append(z.window, rv...)
+	if len(z.window) > deflateWindowSize {
+		z.window = append(z.window[:0], z.window[len(z.window)-deflateWindowSize:]...)
+	}
+	return rv, nil
+}
+
+// finalDeflateBlock is an empty stored block with the 'final' bit set
+var finalDeflateBlock = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+const deflateWindowSize = 32 << 10
+
+// Reset discards the stream state. The next data added must start a new zlib
+// stream.
+func (z *inflateStream) Reset() {
+	if z.reader != nil {
+		z.reader.Close()
+	}
+	z.reader = nil
+	z.input.Reset()
+	z.started = false
+	z.window = nil
+}
+
+// decodeZlib decodes a rectangle in Zlib encoding into rv. The compressed
+// data consists of raw pixel data, and is part of a stream that persists for
+// the whole session.
+func (rfb *RFB) decodeZlib(buf []byte, rv *image.RGBA) (int, error) {
+	if len(buf) < 4 {
+		return len(buf), errTruncated
+	}
+	l := rInt(buf[0:4])
+	if 4+l > len(buf) {
+		return len(buf), errTruncated
+	}
+
+	b := rv.Bounds()
+	raw, err := rfb.zlibStream.Inflate(buf[4:4+l], b.Dx()*b.Dy()*rfb.pixelFormat.BytesPerPixel())
+	if err != nil {
+		return 4 + l, err
+	}
+
+	_, err = rfb.pixelFormat.decodeRawTile(raw, rv, b)
+	return 4 + l, err
+}
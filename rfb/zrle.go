@@ -0,0 +1,260 @@
+package rfb
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// decodeTRLE decodes a rectangle in TRLE encoding into rv. Unlike ZRLE, TRLE
+// tiles may reuse the palette of the tile before them.
+func (rfb *RFB) decodeTRLE(buf []byte, rv *image.RGBA) (int, error) {
+	r := bytes.NewReader(buf)
+	err := rfb.pixelFormat.decodeRLETiles(r, rv, 16, 0, &rfb.trlePalette)
+	n := len(buf) - r.Len()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, errTruncated
+	}
+	return n, err
+}
+
+// decodeZRLE decodes a rectangle in ZRLE encoding into rv. ZRLE is TRLE with
+// larger tiles, compressed using a zlib stream that persists for the whole
+// session. ZYWRLE uses the same format, but applies a wavelet transform to
+// each tile first; pass a nonzero zywrleLevel to reverse this.
+func (rfb *RFB) decodeZRLE(buf []byte, rv *image.RGBA, zywrleLevel int) (int, error) {
+	if len(buf) < 4 {
+		return len(buf), errTruncated
+	}
+	l := rInt(buf[0:4])
+	if 4+l > len(buf) {
+		return len(buf), errTruncated
+	}
+
+	// Inflating the whole rectangle at once means an error in one tile
+	// doesn't affect the next rectangle
+	data, err := rfb.zrleStream.InflateFlushed(buf[4 : 4+l])
+	if err != nil {
+		return 4 + l, err
+	}
+	r := bytes.NewReader(data)
+	err = rfb.pixelFormat.decodeRLETiles(r, rv, 64, zywrleLevel, nil)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errTruncated
+	}
+	return 4 + l, err
+}
+
+// decodeRLETiles reads a rectangle divided into square tiles of the
+// specified size, each of which has one of the (Z)RLE subencodings. If
+// palette is not nil, it holds the palette of the last tile, which tiles can
+// reuse.
+func (ppf PixelFormat) decodeRLETiles(r io.Reader, rv *image.RGBA, tileSize int, zywrleLevel int, palette *[]color.RGBA) error {
+	bounds := rv.Bounds()
+	for ty := bounds.Min.Y; ty < bounds.Max.Y; ty += tileSize {
+		for tx := bounds.Min.X; tx < bounds.Max.X; tx += tileSize {
+			tile := image.Rect(tx, ty, tx+tileSize, ty+tileSize).Intersect(bounds)
+			if err := ppf.decodeRLETile(r, rv, tile, zywrleLevel, palette); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decodeRLETile reads a single tile. ZYWRLE only transforms raw tiles, so
+// the wavelet transform is reversed for those alone.
+func (ppf PixelFormat) decodeRLETile(r io.Reader, rv *image.RGBA, tile image.Rectangle, zywrleLevel int, lastPalette *[]color.RGBA) error {
+	subenc, err := readByte(r)
+	if err != nil {
+		return err
+	}
+
+	w, h := tile.Dx(), tile.Dy()
+
+	if subenc == 0 {
+		// Raw pixels
+		for y := tile.Min.Y; y < tile.Max.Y; y++ {
+			for x := tile.Min.X; x < tile.Max.X; x++ {
+				c, err := ppf.readCPixel(r)
+				if err != nil {
+					return err
+				}
+				rv.SetRGBA(x, y, c)
+			}
+		}
+		if zywrleLevel > 0 {
+			zywrleSynthesize(rv, tile, zywrleLevel)
+		}
+		return nil
+	} else if subenc == 1 {
+		// Solid tile
+		c, err := ppf.readCPixel(r)
+		if err != nil {
+			return err
+		}
+		fillRect(rv, tile, c)
+		return nil
+	} else if subenc <= 16 || (subenc == 127 && lastPalette != nil) {
+		// Packed palette, or reusing the previous one
+		var palette []color.RGBA
+		if subenc == 127 {
+			palette = *lastPalette
+		} else {
+			palette, err = ppf.readCPixelPalette(r, int(subenc))
+			if err != nil {
+				return err
+			}
+			if lastPalette != nil {
+				*lastPalette = palette
+			}
+		}
+
+		bits := uint(4)
+		if len(palette) <= 2 {
+			bits = 1
+		} else if len(palette) <= 4 {
+			bits = 2
+		}
+		lineLength := (w*int(bits) + 7) / 8
+		line := make([]byte, lineLength)
+		mask := byte(1<<bits - 1)
+
+		for j := 0; j < h; j++ {
+			if _, err := io.ReadFull(r, line); err != nil {
+				return err
+			}
+			for i := 0; i < w; i++ {
+				bit := uint(i) * bits
+				idx := int(line[bit/8]>>(8-bits-bit%8)) & int(mask)
+				if idx < len(palette) {
+					rv.SetRGBA(tile.Min.X+i, tile.Min.Y+j, palette[idx])
+				}
+			}
+		}
+		return nil
+	} else if subenc == 128 {
+		// Plain RLE
+		return ppf.decodeRuns(r, rv, tile, func() (color.RGBA, bool, error) {
+			c, err := ppf.readCPixel(r)
+			return c, true, err
+		})
+	} else if subenc >= 130 || (subenc == 129 && lastPalette != nil) {
+		// Palette RLE, or reusing the previous palette
+		var palette []color.RGBA
+		if subenc == 129 {
+			palette = *lastPalette
+		} else {
+			palette, err = ppf.readCPixelPalette(r, int(subenc)-128)
+			if err != nil {
+				return err
+			}
+			if lastPalette != nil {
+				*lastPalette = palette
+			}
+		}
+
+		return ppf.decodeRuns(r, rv, tile, func() (color.RGBA, bool, error) {
+			idx, err := readByte(r)
+			if err != nil {
+				return color.RGBA{}, false, err
+			}
+			var c color.RGBA
+			if int(idx&0x7f) < len(palette) {
+				c = palette[idx&0x7f]
+			}
+			return c, idx&0x80 != 0, nil
+		})
+	}
+
+	return fmt.Errorf("invalid RLE subencoding %d", subenc)
+}
+
+// decodeRuns fills a tile with runs of pixels. The function next returns the
+// colour of the next run, and whether a run length follows.
+func (ppf PixelFormat) decodeRuns(r io.Reader, rv *image.RGBA, tile image.Rectangle, next func() (color.RGBA, bool, error)) error {
+	w := tile.Dx()
+	total := w * tile.Dy()
+
+	for i := 0; i < total; {
+		c, isRun, err := next()
+		if err != nil {
+			return err
+		}
+
+		runLength := 1
+		if isRun {
+			for {
+				b, err := readByte(r)
+				if err != nil {
+					return err
+				}
+				runLength += int(b)
+				if b != 255 {
+					break
+				}
+			}
+		}
+
+		for ; runLength > 0 && i < total; runLength-- {
+			rv.SetRGBA(tile.Min.X+i%w, tile.Min.Y+i/w, c)
+			i++
+		}
+	}
+
+	return nil
+}
+
+func (ppf PixelFormat) readCPixelPalette(r io.Reader, size int) ([]color.RGBA, error) {
+	rv := make([]color.RGBA, size)
+	for i := range rv {
+		c, err := ppf.readCPixel(r)
+		if err != nil {
+			return nil, err
+		}
+		rv[i] = c
+	}
+	return rv, nil
+}
+
+// cPixelSize returns the length of a compressed pixel (CPIXEL). If all colour
+// bits of a 32-bit pixel fit in three bytes, the fourth is not sent.
+func (ppf PixelFormat) cPixelSize() int {
+	if ppf.TrueColour && ppf.Bits == 32 && ppf.Depth <= 24 {
+		mask := ppf.colourMask()
+		if mask < 1<<24 || mask&0xff == 0 {
+			return 3
+		}
+	}
+	return ppf.BytesPerPixel()
+}
+
+// readCPixel reads a single compressed pixel
+func (ppf PixelFormat) readCPixel(r io.Reader) (color.RGBA, error) {
+	var buf [4]byte
+	l := ppf.cPixelSize()
+	if l != 3 {
+		_, err := io.ReadFull(r, buf[:l])
+		_, c := ppf.ReadPixel(buf[:l])
+		return c, err
+	}
+
+	// Find out whether the least or most significant byte was left out, and
+	// put the remaining three in the right place.
+	lsb := ppf.colourMask() < 1<<24
+	start := 0
+	if lsb == ppf.BigEndian {
+		start = 1
+	}
+	_, err := io.ReadFull(r, buf[start:start+3])
+	_, c := ppf.ReadPixel(buf[:])
+	return c, err
+}
+
+func readByte(r io.Reader) (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
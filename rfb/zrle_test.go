@@ -0,0 +1,161 @@
+package rfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// zrleRects compresses the data of each rectangle using a single zlib
+// stream, flushing it after each one as ZRLE servers do, and returns the
+// rectangles as sent
+func zrleRects(rects ...[]byte) [][]byte {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	var rv [][]byte
+	for _, rect := range rects {
+		zw.Write(rect)
+		zw.Flush()
+		l := compressed.Len()
+		rv = append(rv, append([]byte{byte(l >> 24), byte(l >> 16), byte(l >> 8), byte(l)}, compressed.Bytes()...))
+		compressed.Reset()
+	}
+	return rv
+}
+
+func TestZRLEAfterError(t *testing.T) {
+	solidRed := []byte{1, 0x00, 0x00, 0xff}
+	invalid := []byte{17, 1, 2, 3, 4, 5, 6, 7, 8}
+
+	tests := []struct {
+		name string
+		// bad is a rectangle of the given size that fails to decode
+		bad           []byte
+		width, height int
+	}{
+		{"first tile", invalid, 16, 16},
+		{"second tile", append(append([]byte{}, solidRed...), invalid...), 128, 64},
+		{"more output than the window", append(append([]byte{}, invalid...), make([]byte, 100000)...), 16, 16},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rects := zrleRects(tc.bad, solidRed)
+			rfb := &RFB{pixelFormat: StandardPixelFormats["rgb888"]}
+
+			img := image.NewRGBA(image.Rect(0, 0, tc.width, tc.height))
+			if n, err := rfb.decodeZRLE(rects[0], img, 0); err == nil {
+				t.Fatal("invalid subencoding decoded without error")
+			} else if n != len(rects[0]) {
+				t.Errorf("consumed %d bytes; want %d", n, len(rects[0]))
+			}
+
+			// The next rectangle in the stream still decodes
+			img = image.NewRGBA(image.Rect(0, 0, 16, 16))
+			if _, err := rfb.decodeZRLE(rects[1], img, 0); err != nil {
+				t.Fatal(err)
+			}
+			red := color.RGBA{R: 0xff, A: 0xff}
+			if c := img.RGBAAt(5, 5); c != red {
+				t.Errorf("pixel is %v; want %v", c, red)
+			}
+		})
+	}
+}
+
+func TestTRLEPaletteReuse(t *testing.T) {
+	red := color.RGBA{R: 0xff, A: 0xff}
+	blue := color.RGBA{B: 0xff, A: 0xff}
+	packed := func(row ...byte) []byte {
+		var rv []byte
+		for j := 0; j < 16; j++ {
+			rv = append(rv, row...)
+		}
+		return rv
+	}
+	// A two-colour palette of red and blue
+	palette := []byte{0x00, 0x00, 0xff, 0xff, 0x00, 0x00}
+
+	tests := []struct {
+		name  string
+		rects [][]byte
+		// width is the width of each rectangle
+		width int
+		want  func(x, y int) color.RGBA
+		// wantErr is set if the last rectangle doesn't decode
+		wantErr bool
+	}{
+		{
+			"packed palette",
+			[][]byte{concat([]byte{2}, palette, packed(0xaa, 0xaa), []byte{127}, packed(0x55, 0x55))},
+			32,
+			func(x, y int) color.RGBA {
+				if (x < 16) == (x%2 == 0) {
+					return blue
+				}
+				return red
+			},
+			false,
+		},
+		{
+			"palette RLE",
+			[][]byte{concat([]byte{130}, palette, []byte{0x80, 127, 0x81, 127}, []byte{129, 0x81, 255, 0})},
+			32,
+			func(x, y int) color.RGBA {
+				if x < 16 && y < 8 {
+					return red
+				}
+				return blue
+			},
+			false,
+		},
+		{
+			"previous rectangle",
+			[][]byte{
+				concat([]byte{130}, palette, []byte{0x80, 255, 0}),
+				{129, 0x81, 255, 0},
+			},
+			16,
+			func(x, y int) color.RGBA { return blue },
+			false,
+		},
+		{
+			"no previous palette",
+			[][]byte{{127}},
+			16,
+			nil,
+			true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rfb := &RFB{pixelFormat: StandardPixelFormats["rgb888"]}
+			var img *image.RGBA
+			var err error
+			for _, rect := range tc.rects {
+				img = image.NewRGBA(image.Rect(0, 0, tc.width, 16))
+				var n int
+				n, err = rfb.decodeTRLE(rect, img)
+				if err == nil && n != len(rect) {
+					t.Errorf("consumed %d bytes; want %d", n, len(rect))
+				}
+			}
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v; want error: %v", err, tc.wantErr)
+			}
+			if tc.want == nil {
+				return
+			}
+			for y := 0; y < 16; y++ {
+				for x := 0; x < tc.width; x++ {
+					if c := img.RGBAAt(x, y); c != tc.want(x, y) {
+						t.Fatalf("pixel (%d, %d) is %v; want %v", x, y, c, tc.want(x, y))
+					}
+				}
+			}
+		})
+	}
+}
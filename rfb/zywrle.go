@@ -0,0 +1,173 @@
+package rfb
+
+import (
+	"image"
+	"image/color"
+)
+
+// zywrleLevel returns the number of wavelet transform levels a server uses
+// for ZYWRLE, given the JPEG quality level the client requested.
+func zywrleLevel(qualityLevel int) int {
+	if qualityLevel < 0 {
+		return 1
+	} else if qualityLevel < 3 {
+		return 3
+	} else if qualityLevel < 6 {
+		return 2
+	}
+	return 1
+}
+
+// Index of the wavelet coefficients in a zywrleCoeff. These are transmitted
+// in the green, blue and red channels of a pixel, respectively.
+const (
+	zywrleY = 0
+	zywrleU = 1
+	zywrleV = 2
+)
+
+type zywrleCoeff [3]int
+
+// zywrleSynthesize reverses the wavelet transform on a single ZYWRLE tile in
+// img. The tile as transmitted starts with the wavelet coefficients for the
+// part of the tile that is aligned to the transform size, packed by subband
+// and in raster order across the full width of the tile. They are followed
+// by the remaining pixels as they are: first the right edge, then the bottom
+// edge, then the bottom right corner.
+func zywrleSynthesize(img *image.RGBA, tile image.Rectangle, level int) {
+	w := tile.Dx() &^ (1<<uint(level) - 1)
+	h := tile.Dy() &^ (1<<uint(level) - 1)
+	if w == 0 || h == 0 {
+		return
+	}
+
+	// Take the tile as sent, in the order it was sent
+	data := make([]color.RGBA, 0, tile.Dx()*tile.Dy())
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		for x := tile.Min.X; x < tile.Max.X; x++ {
+			data = append(data, img.RGBAAt(x, y))
+		}
+	}
+
+	coeff := make([]zywrleCoeff, w*h)
+
+	// Unpack the coefficients, starting with the highest frequencies
+	pos := 0
+	for l := 0; l < level; l++ {
+		s := 2 << uint(l)
+		for t := 3; t >= 0; t-- {
+			if t == 0 && l != level-1 {
+				continue
+			}
+			x0, y0 := 0, 0
+			if t&1 != 0 {
+				x0 = s >> 1
+			}
+			if t&2 != 0 {
+				y0 = s >> 1
+			}
+
+			for y := y0; y < h; y += s {
+				for x := x0; x < w; x += s {
+					c := data[pos]
+					pos++
+
+					coeff[y*w+x][zywrleY] = int(int8(c.G))
+					coeff[y*w+x][zywrleU] = int(int8(c.B))
+					coeff[y*w+x][zywrleV] = int(int8(c.R))
+				}
+			}
+		}
+	}
+
+	// Put the unaligned pixels back where they belong
+	unaligned := []image.Rectangle{
+		image.Rect(tile.Min.X+w, tile.Min.Y, tile.Max.X, tile.Min.Y+h),
+		image.Rect(tile.Min.X, tile.Min.Y+h, tile.Min.X+w, tile.Max.Y),
+		image.Rect(tile.Min.X+w, tile.Min.Y+h, tile.Max.X, tile.Max.Y),
+	}
+	for _, r := range unaligned {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				img.SetRGBA(x, y, data[pos])
+				pos++
+			}
+		}
+	}
+
+	// Inverse wavelet transform
+	for l := level - 1; l >= 0; l-- {
+		for x := 0; x < w; x += 1 << uint(l) {
+			zywrleWaveletLevel(coeff[x:], h, l, w)
+		}
+		for y := 0; y < h; y += 1 << uint(l) {
+			zywrleWaveletLevel(coeff[y*w:], w, l, 1)
+		}
+	}
+
+	// Convert back to RGB
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := coeff[y*w+x]
+			Y := c[zywrleY] + 128
+			U := c[zywrleU] << 1
+			V := c[zywrleV] << 1
+
+			g := Y - ((U + V) >> 2)
+			b := U + g
+			r := V + g
+
+			img.SetRGBA(tile.Min.X+x, tile.Min.Y+y, color.RGBA{
+				R: clampByte(r),
+				G: clampByte(g),
+				B: clampByte(b),
+				A: 0xff,
+			})
+		}
+	}
+}
+
+// zywrleWaveletLevel applies one level of the piecewise-linear Haar
+// transform to size coefficients, spaced skip elements apart. The transform
+// is its own inverse.
+func zywrleWaveletLevel(data []zywrleCoeff, size, l, skip int) {
+	ofs := (1 << uint(l)) * skip
+	step := (2 << uint(l)) * skip
+	for i := 0; i < size>>uint(l+1); i++ {
+		a, b := &data[i*step], &data[i*step+ofs]
+		for k := range a {
+			a[k], b[k] = zywrleHaar(a[k], b[k])
+		}
+	}
+}
+
+// zywrleHaar performs a piecewise-linear Haar transform on a pair of signed
+// 8-bit values
+func zywrleHaar(x0, x1 int) (int, int) {
+	orgX0, orgX1 := x0, x1
+	if (x0^x1)&0x80 != 0 {
+		// Different signs
+		x1 += x0
+		if (x1^orgX1)&0x80 == 0 {
+			// |x1| > |x0|
+			x0 -= x1
+		}
+	} else {
+		// Same sign
+		x0 -= x1
+		if (x0^orgX0)&0x80 == 0 {
+			// |x0| > |x1|
+			x1 += x0
+		}
+	}
+	return int(int8(x1)), int(int8(x0))
+}
+
+func clampByte(v int) uint8 {
+	if v < 0 {
+		return 0
+	} else if v > 0xff {
+		return 0xff
+	}
+	return uint8(v)
+}
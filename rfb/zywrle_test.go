@@ -0,0 +1,203 @@
+package rfb
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// zywrleAnalyze is the inverse of zywrleSynthesize, following ZYWRLE_ANALYZE
+// in libvncserver's zywrletemplate.c without the quantisation step. It
+// returns the pixels of a tile in the order they are sent.
+func zywrleAnalyze(img *image.RGBA, tile image.Rectangle, level int) []color.RGBA {
+	w := tile.Dx() &^ (1<<uint(level) - 1)
+	h := tile.Dy() &^ (1<<uint(level) - 1)
+
+	var rv []color.RGBA
+	if w == 0 || h == 0 {
+		for y := tile.Min.Y; y < tile.Max.Y; y++ {
+			for x := tile.Min.X; x < tile.Max.X; x++ {
+				rv = append(rv, img.RGBAAt(x, y))
+			}
+		}
+		return rv
+	}
+
+	coeff := make([]zywrleCoeff, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := img.RGBAAt(tile.Min.X+x, tile.Min.Y+y)
+			r, g, b := int(c.R), int(c.G), int(c.B)
+			coeff[y*w+x][zywrleY] = (r+(g<<1)+b)>>2 - 128
+			coeff[y*w+x][zywrleU] = (b - g) >> 1
+			coeff[y*w+x][zywrleV] = (r - g) >> 1
+		}
+	}
+
+	for l := 0; l < level; l++ {
+		for y := 0; y < h; y += 1 << uint(l) {
+			zywrleWaveletLevel(coeff[y*w:], w, l, 1)
+		}
+		for x := 0; x < w; x += 1 << uint(l) {
+			zywrleWaveletLevel(coeff[x:], h, l, w)
+		}
+	}
+
+	for l := 0; l < level; l++ {
+		s := 2 << uint(l)
+		for t := 3; t >= 0; t-- {
+			if t == 0 && l != level-1 {
+				continue
+			}
+			x0, y0 := 0, 0
+			if t&1 != 0 {
+				x0 = s >> 1
+			}
+			if t&2 != 0 {
+				y0 = s >> 1
+			}
+			for y := y0; y < h; y += s {
+				for x := x0; x < w; x += s {
+					c := coeff[y*w+x]
+					rv = append(rv, color.RGBA{
+						R: uint8(c[zywrleV]),
+						G: uint8(c[zywrleY]),
+						B: uint8(c[zywrleU]),
+						A: 0xff,
+					})
+				}
+			}
+		}
+	}
+
+	unaligned := []image.Rectangle{
+		image.Rect(tile.Min.X+w, tile.Min.Y, tile.Max.X, tile.Min.Y+h),
+		image.Rect(tile.Min.X, tile.Min.Y+h, tile.Min.X+w, tile.Max.Y),
+		image.Rect(tile.Min.X+w, tile.Min.Y+h, tile.Max.X, tile.Max.Y),
+	}
+	for _, r := range unaligned {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				rv = append(rv, img.RGBAAt(x, y))
+			}
+		}
+	}
+	return rv
+}
+
+// zywrleTestImage returns an image whose colours survive the conversion to
+// YUV and back unchanged
+func zywrleTestImage(width, height int) *image.RGBA {
+	rv := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			rv.SetRGBA(x, y, color.RGBA{
+				R: uint8(x*36+y*8) &^ 3,
+				G: uint8(x*x+y*20) &^ 3,
+				B: uint8(200-x*4-y*y) &^ 3,
+				A: 0xff,
+			})
+		}
+	}
+	return rv
+}
+
+func writeTestCPixel(buf *bytes.Buffer, c color.RGBA) {
+	buf.Write([]byte{c.B, c.G, c.R})
+}
+
+func TestZYWRLE(t *testing.T) {
+	ppf := StandardPixelFormats["rgb888"]
+
+	tests := []struct {
+		name          string
+		width, height int
+		level         int
+	}{
+		{"aligned", 16, 16, 3},
+		{"full tile", 64, 64, 1},
+		{"unaligned width", 13, 8, 2},
+		{"unaligned height", 8, 11, 3},
+		{"unaligned both", 30, 21, 3},
+		{"smaller than transform", 7, 3, 3},
+		{"several tiles", 70, 66, 2},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			want := zywrleTestImage(tc.width, tc.height)
+			bounds := want.Bounds()
+
+			var buf bytes.Buffer
+			for ty := bounds.Min.Y; ty < bounds.Max.Y; ty += 64 {
+				for tx := bounds.Min.X; tx < bounds.Max.X; tx += 64 {
+					tile := image.Rect(tx, ty, tx+64, ty+64).Intersect(bounds)
+					buf.WriteByte(0)
+					for _, c := range zywrleAnalyze(want, tile, tc.level) {
+						writeTestCPixel(&buf, c)
+					}
+				}
+			}
+
+			got := image.NewRGBA(bounds)
+			if err := ppf.decodeRLETiles(&buf, got, 64, tc.level, nil); err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("%d bytes left over", buf.Len())
+			}
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					if g, w := got.RGBAAt(x, y), want.RGBAAt(x, y); g != w {
+						t.Fatalf("pixel %d,%d is %v; want %v", x, y, g, w)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestZYWRLENonRawTiles(t *testing.T) {
+	ppf := StandardPixelFormats["rgb888"]
+	red := color.RGBA{R: 0xff, A: 0xff}
+	blue := color.RGBA{B: 0xff, A: 0xff}
+
+	tests := []struct {
+		name  string
+		tile  []byte
+		pixel func(x, y int) color.RGBA
+	}{
+		{
+			"solid",
+			[]byte{1, 0x00, 0x00, 0xff},
+			func(x, y int) color.RGBA { return red },
+		},
+		{
+			"packed palette",
+			append([]byte{2, 0x00, 0x00, 0xff, 0xff, 0x00, 0x00}, bytes.Repeat([]byte{0x55}, 16*2)...),
+			func(x, y int) color.RGBA {
+				if x%2 == 0 {
+					return red
+				}
+				return blue
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := image.NewRGBA(image.Rect(0, 0, 16, 16))
+			if err := ppf.decodeRLETiles(bytes.NewReader(tc.tile), got, 64, 3, nil); err != nil {
+				t.Fatal(err)
+			}
+			for y := 0; y < 16; y++ {
+				for x := 0; x < 16; x++ {
+					if g, w := got.RGBAAt(x, y), tc.pixel(x, y); g != w {
+						t.Fatalf("pixel %d,%d is %v; want %v", x, y, g, w)
+					}
+				}
+			}
+		})
+	}
+}